@@ -0,0 +1,245 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// binDir is where the commands of the packages in a node_modules folder are linked
+const binDir = ".bin"
+
+// binMap is the bin field of a package: either a single file, named after the
+// package and kept under the empty key, or a map of command names to files
+type binMap map[string]string
+
+func (b *binMap) UnmarshalJSON(data []byte) error {
+	var m map[string]string
+	if json.Unmarshal(data, &m) == nil {
+		*b = m
+		return nil
+	}
+	var s string
+	if json.Unmarshal(data, &s) == nil && s != "" {
+		*b = binMap{"": s}
+	}
+	//anything else can't be linked anyway
+	return nil
+}
+
+// Bins lists the commands of a package installed in dir, mapped to the slash separated
+// file each one runs, relative to dir. Without a bin field, every file in directories.bin
+// is a command. Commands and files that would end up outside their folder are left out.
+func (p *Package) Bins(dir string) (map[string]string, error) {
+	bins := make(map[string]string, len(p.Bin))
+	add := func(cmd, file string) {
+		cmd = path.Base(strings.Replace(cmd, "\\", "/", -1))
+		file, err := tarEntryPath(file)
+		if cmd == "." || cmd == ".." || cmd == "/" || err != nil || file == "." {
+			log.Warnf("Skipping bad bin %s of %s: %s", cmd, p.Name, file)
+			return
+		}
+		bins[cmd] = file
+	}
+	for cmd, file := range p.Bin {
+		if cmd == "" {
+			cmd = p.Name
+		}
+		add(cmd, file)
+	}
+	if len(p.Bin) > 0 || p.Directories.Bin == "" {
+		return bins, nil
+	}
+
+	binPath, err := tarEntryPath(p.Directories.Bin)
+	if err != nil {
+		log.Warnf("Skipping bad bin directory of %s: %s", p.Name, p.Directories.Bin)
+		return bins, nil
+	}
+	root := filepath.Join(dir, filepath.FromSlash(binPath))
+	err = filepath.Walk(root, func(file string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) && file == root {
+				return nil
+			}
+			return err
+		}
+		if info.IsDir() || strings.HasPrefix(info.Name(), ".") {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, file)
+		if err != nil {
+			return err
+		}
+		add(info.Name(), filepath.ToSlash(rel))
+		return nil
+	})
+	return bins, err
+}
+
+// A binPackage is a package linked into the .bin folder of a node_modules folder
+type binPackage struct {
+	Name string
+	Dir  string
+
+	//set when the owner of the node_modules folder depends on it, rather
+	//than it being there because it was hoisted
+	Direct bool
+}
+
+// linkBins recreates the .bin folder of modules, linking in the commands of the packages.
+// When several packages have the same command, direct dependencies win over hoisted ones,
+// then a package named after the command, then the package whose name sorts first.
+func linkBins(modules string, pkgs []binPackage) error {
+	dir := filepath.Join(modules, binDir)
+	err := os.RemoveAll(dir)
+	if err != nil {
+		return err
+	}
+	pkgs = append([]binPackage(nil), pkgs...)
+	sort.SliceStable(pkgs, func(i, j int) bool {
+		if pkgs[i].Direct != pkgs[j].Direct {
+			return pkgs[i].Direct
+		}
+		return pkgs[i].Name < pkgs[j].Name
+	})
+
+	owners := make(map[string]binPackage, 10)
+	files := make(map[string]string, 10)
+	for _, p := range pkgs {
+		pkg, err := ReadPackage(p.Dir)
+		if os.IsNotExist(err) {
+			//optional packages that failed to install
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		bins, err := pkg.Bins(p.Dir)
+		if err != nil {
+			return err
+		}
+		for _, cmd := range sortedStringKeys(bins) {
+			if prev, ok := owners[cmd]; ok {
+				keep, drop := prev, p
+				if prev.Direct == p.Direct && path.Base(p.Name) == cmd && path.Base(prev.Name) != cmd {
+					keep, drop = p, prev
+				}
+				log.Infof("Both %s and %s have a %s command, using the one of %s", drop.Name, keep.Name, cmd, keep.Name)
+				if keep == prev {
+					continue
+				}
+			}
+			owners[cmd] = p
+			files[cmd] = filepath.Join(p.Dir, filepath.FromSlash(bins[cmd]))
+		}
+	}
+	if len(files) == 0 {
+		return nil
+	}
+
+	err = os.MkdirAll(dir, 0755)
+	if err != nil {
+		return err
+	}
+	for _, cmd := range sortedStringKeys(files) {
+		err = makeExecutable(files[cmd])
+		if err != nil {
+			log.Warnf("Skipping command %s of %s: %s", cmd, owners[cmd].Name, err.Error())
+			continue
+		}
+		rel, err := filepath.Rel(dir, files[cmd])
+		if err != nil {
+			return err
+		}
+		err = os.Symlink(rel, filepath.Join(dir, cmd))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// makeExecutable sets the executable bits of a file. The file is replaced with a
+// copy rather than changed in place, since it may be hardlinked from the store.
+func makeExecutable(file string) error {
+	info, err := os.Stat(file)
+	if err != nil {
+		return err
+	}
+	if info.Mode()&0111 == 0111 {
+		return nil
+	}
+	return copyFile(file, 0755)
+}
+
+// binLevels lists the node_modules folders of an install that get a .bin folder,
+// along with the packages in each. In the hoisted layout that's the top and every
+// package with nested ones, in the isolated one the top and every package's own.
+func (in *Installer) binLevels(t *DependencyTree) (map[string][]binPackage, error) {
+	modules := filepath.Join(in.Dir, "node_modules")
+	levels := make(map[string][]binPackage, 10)
+	if in.Layout == LayoutIsolated {
+		pkgs, root, err := in.isolatedLayout(t)
+		if err != nil {
+			return nil, err
+		}
+		for name := range root {
+			levels[modules] = append(levels[modules], binPackage{name, filepath.Join(modules, filepath.FromSlash(name)), true})
+		}
+		for key, p := range pkgs {
+			level := filepath.Join(modules, isolatedDir, key, "node_modules")
+			for name := range p.Deps {
+				if name != p.Node.Name {
+					levels[level] = append(levels[level], binPackage{name, filepath.Join(level, filepath.FromSlash(name)), true})
+				}
+			}
+		}
+		return levels, nil
+	}
+
+	nodes, err := in.nodes(t)
+	if err != nil {
+		return nil, err
+	}
+	levels[modules] = nil
+	for _, n := range nodes {
+		dir := filepath.Join(modules, filepath.FromSlash(n.Path()))
+		if _, err := os.Stat(dir); err != nil {
+			//optional packages that failed to install
+			continue
+		}
+		levels[filepath.Join(dir, "node_modules")] = nil
+		level, direct := modules, false
+		if n.Parent == nil {
+			for _, kind := range []int{depProd, depDev, depOptional} {
+				direct = direct || t.requires(kind)[n.Name] != ""
+			}
+		} else {
+			level = filepath.Join(modules, filepath.FromSlash(n.Parent.Path()), "node_modules")
+			_, direct = n.Parent.requirement(n.Name)
+		}
+		levels[level] = append(levels[level], binPackage{n.Name, dir, direct})
+	}
+	return levels, nil
+}
+
+// link creates the .bin folders of an install
+func (in *Installer) link(t *DependencyTree) error {
+	levels, err := in.binLevels(t)
+	if err != nil {
+		return err
+	}
+	for level, pkgs := range levels {
+		err = linkBins(level, pkgs)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLinkBins(t *testing.T) {
+	modules := filepath.Join(_testDir(t, "fpm-bin"), "node_modules")
+	files := map[string]string{
+		"@scope/tool/package.json": `{"name":"@scope/tool","bin":"cli.js"}`,
+		"@scope/tool/cli.js":       "tool",
+		"both/package.json":        `{"name":"both","bin":{"both":"./a.js","tool":"b.js","evil":"../../x"}}`,
+		"both/a.js":                "both",
+		"both/b.js":                "both tool",
+		"dir/package.json":         `{"name":"dir","directories":{"bin":"scripts"}}`,
+		"dir/scripts/dir-run":      "dir",
+		"hoisted/package.json":     `{"name":"hoisted","bin":{"both":"x.js"}}`,
+		"hoisted/x.js":             "hoisted",
+	}
+	for name, data := range files {
+		path := filepath.Join(modules, filepath.FromSlash(name))
+		os.MkdirAll(filepath.Dir(path), 0755)
+		err := ioutil.WriteFile(path, []byte(data), 0644)
+		if err != nil {
+			t.Fatalf("Failed to write %s: %s\n", name, err.Error())
+		}
+	}
+
+	err := linkBins(modules, []binPackage{
+		{"hoisted", filepath.Join(modules, "hoisted"), false},
+		{"both", filepath.Join(modules, "both"), true},
+		{"dir", filepath.Join(modules, "dir"), true},
+		{"@scope/tool", filepath.Join(modules, "@scope", "tool"), true},
+	})
+	if err != nil {
+		t.Fatalf("Failed to link bins: %s\n", err.Error())
+	}
+	//direct dependencies win, then the package named after the command
+	expected := map[string]string{"both": "both", "tool": "tool", "dir-run": "dir"}
+	for cmd, content := range expected {
+		path := filepath.Join(modules, binDir, cmd)
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Errorf("Failed to read command %s: %s", cmd, err.Error())
+			continue
+		}
+		if string(data) != content {
+			t.Errorf("Expected command %s to run '%s' but got '%s'", cmd, content, string(data))
+		}
+		info, err := os.Stat(path)
+		if err == nil && info.Mode()&0111 != 0111 {
+			t.Errorf("Expected command %s to be executable but got %s", cmd, info.Mode())
+		}
+	}
+	infos, err := ioutil.ReadDir(filepath.Join(modules, binDir))
+	if err != nil {
+		t.Fatalf("Failed to list bins: %s\n", err.Error())
+	}
+	if len(infos) != len(expected) {
+		t.Errorf("Expected %d commands but got %d", len(expected), len(infos))
+	}
+}
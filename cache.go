@@ -0,0 +1,253 @@
+package main
+
+import (
+	"compress/gzip"
+	"crypto/sha512"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"hash"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// A Cache keeps downloaded package tarballs on disk, addressed by their integrity
+// hash, so they're shared between every project and checked whenever they're used
+type Cache struct {
+	Dir string
+}
+
+// CacheEntry describes a single tarball held in the cache
+type CacheEntry struct {
+	Name      string
+	Version   string
+	Integrity string
+	Path      string
+	Size      int64
+}
+
+func NewCache(dir string) *Cache {
+	return &Cache{Dir: dir}
+}
+
+func (c *Cache) contentDir() string {
+	return filepath.Join(c.Dir, "content")
+}
+
+// contentPath is where a tarball with the hash is kept, e.g. content/sha512/ab/cdef....tgz
+func (c *Cache) contentPath(i integrity) string {
+	h := i.Hex()
+	return filepath.Join(c.contentDir(), i.algo, h[:2], h[2:]+".tgz")
+}
+
+// Tarball returns the path to the cached tarball of a node, downloading it first if needed.
+// Cached tarballs are checked against the node's integrity every time, and evicted when
+// they don't match. Nodes without an integrity or shasum can't be looked up, so they're
+// always downloaded.
+func (c *Cache) Tarball(n *DependencyNode) (string, error) {
+	i, ok := nodeIntegrity(n)
+	if ok {
+		path := c.contentPath(i)
+		err := verifyFile(path, i)
+		if err == nil {
+			return path, nil
+		}
+		if !os.IsNotExist(err) {
+			log.Warnf("Evicting corrupt cache entry for %s@%s: %s", n.Name, n.Version, err.Error())
+			err = c.remove(path)
+			if err != nil {
+				return "", err
+			}
+		}
+	}
+
+	err := os.MkdirAll(c.contentDir(), 0755)
+	if err != nil {
+		return "", err
+	}
+	log.Debugf("Download %s@%s from: %s", n.Name, n.Version, n.Tarball)
+	res, err := http.Get(n.Tarball)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		ioutil.ReadAll(res.Body)
+		return "", &ResponseError{res.StatusCode, res.Status}
+	}
+
+	tmp, err := ioutil.TempFile(c.contentDir(), ".download-")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp.Name())
+	h := sha512.New()
+	var expected hash.Hash
+	w := io.MultiWriter(tmp, h)
+	if ok {
+		expected = i.newHash()
+		w = io.MultiWriter(tmp, h, expected)
+	}
+	_, err = io.Copy(w, res.Body)
+	tmp.Close()
+	if err != nil {
+		return "", err
+	}
+	if ok && hex.EncodeToString(expected.Sum(nil)) != i.Hex() {
+		return "", errors.New("Integrity mismatch for " + n.Name + "@" + n.Version + ", expected " + i.String())
+	}
+	if !ok {
+		i = integrity{"sha512", h.Sum(nil)}
+	}
+
+	path := c.contentPath(i)
+	err = os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return "", err
+	}
+	err = os.Rename(tmp.Name(), path)
+	if err != nil {
+		return "", err
+	}
+	data, err := json.Marshal(CacheEntry{Name: n.Name, Version: n.Version, Integrity: i.String()})
+	if err != nil {
+		return "", err
+	}
+	return path, writeFileAtomic(path+".json", data)
+}
+
+// verifyFile checks a cached file against its hash
+func verifyFile(path string, i integrity) error {
+	fd, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+	return i.check(fd)
+}
+
+// remove evicts a tarball along with what's recorded about it
+func (c *Cache) remove(path string) error {
+	err := os.Remove(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	err = os.Remove(path + ".json")
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// List returns every tarball in the cache, sorted by name
+func (c *Cache) List() ([]CacheEntry, error) {
+	entries := make([]CacheEntry, 0, 100)
+	root := c.contentDir()
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) && path == root {
+				return nil
+			}
+			return err
+		}
+		if info.IsDir() || !strings.HasSuffix(path, ".tgz") {
+			return nil
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		//algo/ab/cdef.tgz
+		parts := strings.Split(filepath.ToSlash(strings.TrimSuffix(rel, ".tgz")), "/")
+		if len(parts) != 3 {
+			return nil
+		}
+		digest, err := hex.DecodeString(parts[1] + parts[2])
+		if err != nil {
+			return nil
+		}
+		e := CacheEntry{Integrity: integrity{parts[0], digest}.String()}
+		//entries without a readable record are still listed, to be verified or cleaned
+		if data, err := ioutil.ReadFile(path + ".json"); err == nil {
+			json.Unmarshal(data, &e)
+		}
+		e.Path = path
+		e.Size = info.Size()
+		entries = append(entries, e)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Sort(cacheEntries(entries))
+	return entries, nil
+}
+
+type cacheEntries []CacheEntry
+
+func (e cacheEntries) Len() int      { return len(e) }
+func (e cacheEntries) Swap(i, j int) { e[i], e[j] = e[j], e[i] }
+func (e cacheEntries) Less(i, j int) bool {
+	if e[i].Name == e[j].Name {
+		return e[i].Version < e[j].Version
+	}
+	return e[i].Name < e[j].Name
+}
+
+// Verify checks every tarball in the cache against the hash it's stored under and
+// makes sure it can be read, removing the ones that fail. It returns the entries that were removed.
+func (c *Cache) Verify() ([]CacheEntry, error) {
+	entries, err := c.List()
+	if err != nil {
+		return nil, err
+	}
+	bad := make([]CacheEntry, 0, 10)
+	for _, e := range entries {
+		err = checkTarball(e)
+		if err == nil {
+			continue
+		}
+		log.Warnf("Removing corrupt cache entry %s@%s: %s", e.Name, e.Version, err.Error())
+		err = c.remove(e.Path)
+		if err != nil {
+			return bad, err
+		}
+		bad = append(bad, e)
+	}
+	return bad, nil
+}
+
+// Clean removes every tarball from the cache
+func (c *Cache) Clean() error {
+	return os.RemoveAll(c.contentDir())
+}
+
+func checkTarball(e CacheEntry) error {
+	n := &DependencyNode{Integrity: e.Integrity}
+	i, ok := nodeIntegrity(n)
+	if !ok {
+		return errors.New("Unknown integrity: " + e.Integrity)
+	}
+	err := verifyFile(e.Path, i)
+	if err != nil {
+		return err
+	}
+	fd, err := os.Open(e.Path)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+	gz, err := gzip.NewReader(fd)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(ioutil.Discard, gz)
+	return err
+}
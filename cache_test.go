@@ -0,0 +1,80 @@
+package main
+
+import (
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func TestCache_Tarball(t *testing.T) {
+	_, _, dir, tree := _testProject(t, testPackages{
+		"a@1.0.0": nil,
+	}, map[string]string{"a": "^1"})
+	n := tree.Nodes["a"]
+	if !strings.HasPrefix(n.Integrity, "sha512-") {
+		t.Fatalf("Expected a sha512 integrity but got: %s\n", n.Integrity)
+	}
+	c := NewCache(dir)
+	path, err := c.Tarball(n)
+	if err != nil {
+		t.Fatalf("Failed to fetch tarball: %s\n", err.Error())
+	}
+
+	//a corrupt entry is evicted and downloaded again
+	err = ioutil.WriteFile(path, []byte("garbage"), 0644)
+	if err != nil {
+		t.Fatalf("Failed to corrupt tarball: %s\n", err.Error())
+	}
+	again, err := c.Tarball(n)
+	if err != nil {
+		t.Fatalf("Failed to fetch tarball: %s\n", err.Error())
+	}
+	if again != path {
+		t.Errorf("Expected the same path for the same integrity, got %s and %s", path, again)
+	}
+	if err := verifyFile(again, _integrity(t, n)); err != nil {
+		t.Errorf("Expected a good tarball after eviction: %s", err.Error())
+	}
+
+	//the same tarball only known by its shasum is kept apart
+	sha1Node := &DependencyNode{Name: n.Name, Version: n.Version, Tarball: n.Tarball, Shasum: n.Shasum}
+	_, err = c.Tarball(sha1Node)
+	if err != nil {
+		t.Fatalf("Failed to fetch tarball by shasum: %s\n", err.Error())
+	}
+	err = ioutil.WriteFile(path, []byte("garbage"), 0644)
+	if err != nil {
+		t.Fatalf("Failed to corrupt tarball: %s\n", err.Error())
+	}
+	bad, err := c.Verify()
+	if err != nil {
+		t.Fatalf("Failed to verify: %s\n", err.Error())
+	}
+	if len(bad) != 1 || bad[0].Name != "a" || bad[0].Integrity != n.Integrity {
+		t.Errorf("Expected the corrupt sha512 entry of a to be removed but got: %v", bad)
+	}
+	entries, err := c.List()
+	if err != nil {
+		t.Fatalf("Failed to list cache: %s\n", err.Error())
+	}
+	if len(entries) != 1 || !strings.HasPrefix(entries[0].Integrity, "sha1-") {
+		t.Errorf("Expected only the sha1 entry to be left but got: %v", entries)
+	}
+
+	err = c.Clean()
+	if err != nil {
+		t.Fatalf("Failed to clean: %s\n", err.Error())
+	}
+	entries, err = c.List()
+	if err != nil || len(entries) != 0 {
+		t.Errorf("Expected an empty cache after cleaning but got: %v", entries)
+	}
+}
+
+func _integrity(t *testing.T, n *DependencyNode) integrity {
+	i, ok := nodeIntegrity(n)
+	if !ok {
+		t.Fatalf("Expected an integrity for %s@%s\n", n.Name, n.Version)
+	}
+	return i
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+
+	"github.com/mastercactapus/go-fpm/omap"
+)
+
+// dependencySections are the package.json fields a dependency can be saved to
+var dependencySections = []string{"dependencies", "devDependencies", "optionalDependencies"}
+
+// saveDependency puts a dependency into a section of package.json, taking it
+// out of any other one. Like npm, the section ends up sorted by name.
+func saveDependency(f *PackageFile, section, name, rng string) error {
+	for _, s := range dependencySections {
+		if s == section {
+			continue
+		}
+		_, err := removeDependency(f, s, name)
+		if err != nil {
+			return err
+		}
+	}
+	deps, err := f.Section(section)
+	if err != nil {
+		return err
+	}
+	data, err := marshalRaw(rng)
+	if err != nil {
+		return err
+	}
+	deps.Set(name, data)
+	keys := deps.Keys()
+	sort.Strings(keys)
+	sorted := omap.NewOrderedMap()
+	for _, k := range keys {
+		sorted.Set(k, deps.Get(k))
+	}
+	return f.SetSection(section, sorted)
+}
+
+// removeDependency takes a dependency out of a section of package.json, reporting if it was there
+func removeDependency(f *PackageFile, section, name string) (bool, error) {
+	if f.Fields.Get(section) == nil {
+		return false, nil
+	}
+	deps, err := f.Section(section)
+	if err != nil {
+		return false, err
+	}
+	if deps.Get(name) == nil {
+		return false, nil
+	}
+	deps.Delete(name)
+	return true, f.SetSection(section, deps)
+}
+
+// addSpec works out the range to save for a "name@range" argument. Without a
+// range, or with a tag, it's a caret range on the version that would be picked.
+func addSpec(r *Registry, spec string) (name, rng string, err error) {
+	name, rng = splitSpec(spec)
+	if rng != "" {
+		tags, err := r.PackageTags(name)
+		if err != nil {
+			return "", "", err
+		}
+		if tags[rng] == "" {
+			req, err := NewSemverRequirements(rng)
+			if err != nil {
+				return "", "", err
+			}
+			_, err = r.LatestCompatablePackageVersion(name, req)
+			return name, rng, err
+		}
+		return name, "^" + tags[rng], nil
+	}
+	v, err := r.LatestPackageVersion(name)
+	if err != nil {
+		return "", "", err
+	}
+	return name, "^" + v.String(), nil
+}
+
+// updateProject resolves an edited package.json, keeping what the lockfile already
+// has where it can, then writes everything and updates node_modules to match
+func updateProject(o *options, f *PackageFile, ropts ResolveOptions) error {
+	pkg, err := f.Package()
+	if err != nil {
+		return err
+	}
+	var old *DependencyTree
+	lock, err := ReadLockfile(o.lockfilePath())
+	if err == nil {
+		old = lock.Tree()
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	ropts.Locked = old
+	in, err := o.installer(pkg)
+	if err != nil {
+		return err
+	}
+	in.Platform = ropts.Target
+	tree, err := resolveAhead(o, in, pkg, ropts)
+	if err != nil {
+		return err
+	}
+
+	err = f.Write()
+	if err != nil {
+		return err
+	}
+	err = NewLockfile(pkg, tree).Write(o.lockfilePath())
+	if err != nil {
+		return err
+	}
+	return install(o, in, pkg, tree)
+}
+
+func cmdAdd(args []string) error {
+	fs, o := newFlagSet("add")
+	dev := fs.Bool("dev", false, "save to devDependencies")
+	fs.BoolVar(dev, "D", false, "short for -dev")
+	optional := fs.Bool("optional", false, "save to optionalDependencies")
+	fs.BoolVar(optional, "O", false, "short for -optional")
+	var ropts ResolveOptions
+	platformFlags(fs, &ropts.Target)
+	pos, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(pos) == 0 {
+		fs.Usage()
+		return errors.New("Expected at least one package")
+	}
+	err = o.setup()
+	if err != nil {
+		return err
+	}
+	ropts.Target.Node = NodeVersion()
+
+	section := "dependencies"
+	if *dev {
+		section = "devDependencies"
+	} else if *optional {
+		section = "optionalDependencies"
+	}
+	f, err := ReadPackageFile(o.dir)
+	if err != nil {
+		return err
+	}
+	r := o.registryClient()
+	for _, spec := range pos {
+		name, rng, err := addSpec(r, spec)
+		if err != nil {
+			return err
+		}
+		err = saveDependency(f, section, name, rng)
+		if err != nil {
+			return err
+		}
+		if !o.json {
+			fmt.Printf("+ %s@%s\n", name, rng)
+		}
+	}
+	return updateProject(o, f, ropts)
+}
+
+func cmdRemove(args []string) error {
+	fs, o := newFlagSet("remove")
+	var ropts ResolveOptions
+	platformFlags(fs, &ropts.Target)
+	pos, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(pos) == 0 {
+		fs.Usage()
+		return errors.New("Expected at least one package")
+	}
+	err = o.setup()
+	if err != nil {
+		return err
+	}
+	ropts.Target.Node = NodeVersion()
+
+	f, err := ReadPackageFile(o.dir)
+	if err != nil {
+		return err
+	}
+	for _, name := range pos {
+		found := false
+		for _, section := range dependencySections {
+			ok, err := removeDependency(f, section, name)
+			if err != nil {
+				return err
+			}
+			found = found || ok
+		}
+		if !found {
+			return errors.New("Not a dependency: " + name)
+		}
+		if !o.json {
+			fmt.Printf("- %s\n", name)
+		}
+	}
+	return updateProject(o, f, ropts)
+}
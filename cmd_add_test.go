@@ -0,0 +1,53 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestSaveDependency(t *testing.T) {
+	f, dir := _testPackageFile(t, testPackageJSON)
+	defer os.RemoveAll(dir)
+
+	err := saveDependency(f, "dependencies", "bb", "^2.0.0")
+	if err != nil {
+		t.Fatalf("Failed to save dependency: %s\n", err.Error())
+	}
+	err = saveDependency(f, "devDependencies", "a", "^1.0.0")
+	if err != nil {
+		t.Fatalf("Failed to save dependency: %s\n", err.Error())
+	}
+	ok, err := removeDependency(f, "dependencies", "d")
+	if err != nil || !ok {
+		t.Fatalf("Failed to remove dependency: %v\n", err)
+	}
+	err = f.Write()
+	if err != nil {
+		t.Fatalf("Failed to write package.json: %s\n", err.Error())
+	}
+	data, err := ioutil.ReadFile(f.Path)
+	if err != nil {
+		t.Fatalf("Failed to read package.json: %s\n", err.Error())
+	}
+	expected := `{
+    "name": "app",
+    "version": "1.0.0",
+    "scripts": {
+        "test": "lint && test"
+    },
+    "dependencies": {
+        "b": "~1.0.0",
+        "bb": "^2.0.0",
+        "c": "1.x"
+    },
+    "devDependencies": {
+        "a": "^1.0.0",
+        "e": "1.0.0"
+    }
+}
+`
+	if string(data) != expected {
+		t.Errorf("Expected package.json:\n%s\nbut got:\n%s", expected, string(data))
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+func cmdCache(args []string) error {
+	fs, o := newFlagSet("cache")
+	pos, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(pos) != 1 {
+		fs.Usage()
+		return errors.New("Expected one of: ls, clean, verify")
+	}
+	err = o.setup()
+	if err != nil {
+		return err
+	}
+	c := o.cache()
+
+	switch pos[0] {
+	case "ls":
+		entries, err := c.List()
+		if err != nil {
+			return err
+		}
+		if o.json {
+			return printJSON(entries)
+		}
+		for _, e := range entries {
+			fmt.Printf("%s@%s %d\n", e.Name, e.Version, e.Size)
+		}
+	case "clean":
+		err = c.Clean()
+		if err != nil {
+			return err
+		}
+		err = o.store().Clean()
+		if err != nil {
+			return err
+		}
+		if !o.json {
+			fmt.Println("cache cleaned")
+		}
+	case "verify":
+		bad, err := c.Verify()
+		if err != nil {
+			return err
+		}
+		if o.json {
+			return printJSON(map[string]interface{}{"removed": bad})
+		}
+		fmt.Printf("verified cache, removed %d corrupt entries\n", len(bad))
+	default:
+		fs.Usage()
+		return errors.New("Unknown cache command: " + pos[0])
+	}
+	return nil
+}
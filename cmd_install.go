@@ -0,0 +1,145 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+)
+
+func cmdInstall(args []string) error {
+	fs, o := newFlagSet("install")
+	omit := make(omitFlag)
+	fs.Var(omit, "omit", "leave out `dev,optional,peer` dependencies when installing")
+	var ropts ResolveOptions
+	fs.BoolVar(&ropts.LegacyPeerDeps, "legacy-peer-deps", false, "ignore peer dependencies, like npm 6 did")
+	fs.BoolVar(&ropts.Solver, "solver", false, "backtrack to find one version of every package, installed flat")
+	platformFlags(fs, &ropts.Target)
+	fs.StringVar(&ropts.Target.Node, "target-node", "", "node `version` to check engines against (default: node on the PATH)")
+	fs.BoolVar(&ropts.EngineStrict, "engine-strict", false, "fail when a package wants a different node version")
+	fs.BoolVar(&ropts.PreferNonDeprecated, "prefer-non-deprecated", false, "avoid deprecated versions when the range allows another")
+	fs.BoolVar(&ropts.PreferLowest, "prefer-lowest", false, "pick the lowest version matching each range instead of the highest")
+	rollback := fs.Bool("rollback", false, "undo an interrupted install, instead of starting it over")
+	pos, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(pos) > 0 {
+		return errors.New("Unexpected argument: " + pos[0])
+	}
+	err = o.setup()
+	if err != nil {
+		return err
+	}
+	if *rollback {
+		undone, err := NewInstaller(o.dir, o.cache()).Rollback()
+		if err != nil {
+			return err
+		}
+		if undone {
+			fmt.Println("Rolled back an interrupted install")
+		} else {
+			fmt.Println("No interrupted install to roll back")
+		}
+		return nil
+	}
+	if ropts.Target.Node == "" {
+		ropts.Target.Node = NodeVersion()
+	}
+
+	pkg, err := ReadPackage(o.dir)
+	if err != nil {
+		return err
+	}
+	in, err := o.installer(pkg)
+	if err != nil {
+		return err
+	}
+	in.Omit = omit
+	in.Platform = ropts.Target
+	tree, err := resolveAhead(o, in, pkg, ropts)
+	if err != nil {
+		return err
+	}
+	err = NewLockfile(pkg, tree).Write(o.lockfilePath())
+	if err != nil {
+		return err
+	}
+	return install(o, in, pkg, tree)
+}
+
+func cmdCI(args []string) error {
+	fs, o := newFlagSet("ci")
+	omit := make(omitFlag)
+	fs.Var(omit, "omit", "leave out `dev,optional,peer` dependencies when installing")
+	var target Platform
+	platformFlags(fs, &target)
+	pos, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(pos) > 0 {
+		return errors.New("Unexpected argument: " + pos[0])
+	}
+	err = o.setup()
+	if err != nil {
+		return err
+	}
+
+	pkg, err := ReadPackage(o.dir)
+	if err != nil {
+		return err
+	}
+	lock, err := ReadLockfile(o.lockfilePath())
+	if err != nil {
+		return err
+	}
+	err = lock.Satisfies(pkg)
+	if err != nil {
+		return errors.New("Lockfile is out of sync with package.json, run install: " + err.Error())
+	}
+	in, err := o.installer(pkg)
+	if err != nil {
+		return err
+	}
+	in.Omit = omit
+	in.Platform = target
+	return install(o, in, pkg, lock.Tree())
+}
+
+// platformFlags adds flags to pick the os, cpu and libc to install for, defaulting to the current ones
+func platformFlags(fs *flag.FlagSet, p *Platform) {
+	*p = CurrentPlatform()
+	fs.StringVar(&p.OS, "target-os", p.OS, "`os` to install for, using node's names")
+	fs.StringVar(&p.CPU, "target-cpu", p.CPU, "`cpu` to install for, using node's names")
+	fs.StringVar(&p.Libc, "target-libc", p.Libc, "`libc` to install for, glibc or musl")
+}
+
+// resolveAhead calculates the tree, feeding the installer's Pipeline
+// with packages as they're settled so they're ready when it's done
+func resolveAhead(o *options, in *Installer, pkg *Package, ropts ResolveOptions) (*DependencyTree, error) {
+	p := in.Pipeline()
+	ropts.Settled = p.Add
+	tree, err := CalculateTree(o.registryClient(), pkg, ropts)
+	p.Wait()
+	return tree, err
+}
+
+func install(o *options, in *Installer, pkg *Package, tree *DependencyTree) error {
+	err := in.RunProjectScripts(pkg, projectPreEvents)
+	if err != nil {
+		return err
+	}
+	changed, removed, err := in.Update(tree)
+	if err != nil {
+		return err
+	}
+	err = in.RunProjectScripts(pkg, projectEvents)
+	if err != nil {
+		return err
+	}
+	if o.json {
+		return printJSON(map[string]int{"changed": changed, "removed": removed})
+	}
+	fmt.Printf("changed %d packages, removed %d packages\n", changed, removed)
+	return nil
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+)
+
+// loadTree reads the resolved tree of the project from its lockfile
+func loadTree(o *options) (*Lockfile, *DependencyTree, error) {
+	lock, err := ReadLockfile(o.lockfilePath())
+	if os.IsNotExist(err) {
+		return nil, nil, errors.New("No " + LockfileName + " found, run install first")
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	return lock, lock.Tree(), nil
+}
+
+func cmdLs(args []string) error {
+	fs, o := newFlagSet("ls")
+	pos, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(pos) > 0 {
+		return errors.New("Unexpected argument: " + pos[0])
+	}
+	err = o.setup()
+	if err != nil {
+		return err
+	}
+	lock, tree, err := loadTree(o)
+	if err != nil {
+		return err
+	}
+	if o.json {
+		return printJSON(lock)
+	}
+	tree.Print(os.Stdout)
+	return nil
+}
+
+func cmdWhy(args []string) error {
+	fs, o := newFlagSet("why")
+	pos, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(pos) != 1 {
+		fs.Usage()
+		return errors.New("Expected a single package name")
+	}
+	err = o.setup()
+	if err != nil {
+		return err
+	}
+	_, tree, err := loadTree(o)
+	if err != nil {
+		return err
+	}
+
+	name, rng := splitSpec(pos[0])
+	var req *SemverRequirements
+	if rng != "" {
+		req, err = NewSemverRequirements(rng)
+		if err != nil {
+			return err
+		}
+	}
+
+	type step struct {
+		Name    string `json:"name"`
+		Version string `json:"version"`
+		Range   string `json:"range"`
+	}
+	type match struct {
+		Package  string   `json:"package"`
+		Location string   `json:"location"`
+		Paths    [][]step `json:"paths"`
+
+		//only the shortest paths were kept
+		Truncated bool `json:"truncated,omitempty"`
+
+		edges [][]DependencyEdge
+	}
+	found := make([]match, 0, 10)
+	tree.Walk(func(n *DependencyNode) {
+		if n.Name != name {
+			return
+		}
+		if req != nil {
+			sv, err := parseDown(n.Version)
+			if err != nil || !req.SatisfiedBy(sv) {
+				return
+			}
+		}
+		m := match{Package: n.Name + "@" + n.Version, Location: "node_modules/" + n.Path(), Paths: make([][]step, 0, 10)}
+		m.edges, m.Truncated = tree.PathsTo(n)
+		for _, path := range m.edges {
+			steps := make([]step, 0, len(path))
+			for _, e := range path {
+				steps = append(steps, step{e.To.Name, e.To.Version, e.Range})
+			}
+			m.Paths = append(m.Paths, steps)
+		}
+		found = append(found, m)
+	})
+	if len(found) == 0 {
+		return errors.New("Package not found in tree: " + pos[0])
+	}
+	if o.json {
+		return printJSON(found)
+	}
+	for i, m := range found {
+		if i > 0 {
+			fmt.Println()
+		}
+		fmt.Printf("%s (%s)\n", m.Package, m.Location)
+		for _, path := range m.edges {
+			fmt.Println("  " + formatPath(path))
+		}
+		if m.Truncated {
+			fmt.Printf("  ...only the %d shortest paths are shown\n", maxPaths)
+		}
+	}
+	return nil
+}
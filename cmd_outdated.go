@@ -0,0 +1,134 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"text/tabwriter"
+)
+
+type outdatedEntry struct {
+	Name    string `json:"-"`
+	Type    string `json:"type"`
+	Current string `json:"current,omitempty"`
+	Wanted  string `json:"wanted"`
+	Latest  string `json:"latest"`
+
+	//the latest version is a new major version past the current one, or the wanted one if missing
+	MajorBehind bool `json:"majorBehind,omitempty"`
+}
+
+// findOutdated compares the current version of each direct dependency, as returned by
+// current, with the highest one its range allows and the latest one. Up to date
+// dependencies are left out, and the rest are sorted by name.
+func findOutdated(r *Registry, pkg *Package, current func(name string) string) ([]outdatedEntry, error) {
+	sections := []struct {
+		name string
+		deps DependencyMap
+	}{
+		//optional dependencies are also listed under dependencies, but like when
+		//resolving, the range they have as optional ones is what counts
+		{"optionalDependencies", pkg.OptionalDependencies},
+		{"dependencies", pkg.Dependencies},
+		{"devDependencies", pkg.DevDependencies},
+	}
+	result := make([]outdatedEntry, 0, 10)
+	seen := make(map[string]bool, len(pkg.Dependencies)+len(pkg.DevDependencies))
+	for _, s := range sections {
+		r.cacheAll(s.deps)
+		for _, name := range sortedReqKeys(s.deps) {
+			if seen[name] {
+				continue
+			}
+			seen[name] = true
+			wanted, err := r.LatestCompatablePackageVersion(name, s.deps[name])
+			if err != nil {
+				return nil, err
+			}
+			latest, err := r.LatestPackageVersion(name)
+			if err != nil {
+				return nil, err
+			}
+			e := outdatedEntry{Name: name, Type: s.name, Current: current(name), Wanted: wanted.String(), Latest: latest.String()}
+			if e.Current == e.Wanted && e.Current == e.Latest {
+				continue
+			}
+			from := wanted
+			if sv, err := parseDown(e.Current); e.Current != "" && err == nil {
+				from = sv
+			}
+			e.MajorBehind = latest.Major > from.Major
+			result = append(result, e)
+		}
+	}
+	sort.SliceStable(result, func(i, j int) bool {
+		return result[i].Name < result[j].Name
+	})
+	return result, nil
+}
+
+func cmdOutdated(args []string) error {
+	fs, o := newFlagSet("outdated")
+	pos, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(pos) > 0 {
+		return errors.New("Unexpected argument: " + pos[0])
+	}
+	err = o.setup()
+	if err != nil {
+		return err
+	}
+
+	pkg, err := ReadPackage(o.dir)
+	if err != nil {
+		return err
+	}
+	var locked map[string]*lockEntry
+	lock, err := ReadLockfile(o.lockfilePath())
+	if err == nil {
+		locked = lock.Dependencies
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	//what's in node_modules wins over what the lockfile says should be there
+	current := func(name string) string {
+		installed, err := ReadPackage(filepath.Join(o.dir, "node_modules", filepath.FromSlash(name)))
+		if err == nil {
+			return installed.Version
+		}
+		if locked[name] != nil {
+			return locked[name].Version
+		}
+		return ""
+	}
+
+	result, err := findOutdated(o.registryClient(), pkg, current)
+	if err != nil {
+		return err
+	}
+	if o.json {
+		m := make(map[string]outdatedEntry, len(result))
+		for _, e := range result {
+			m[e.Name] = e
+		}
+		return printJSON(m)
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "Package\tCurrent\tWanted\tLatest\tType")
+	for _, e := range result {
+		current := e.Current
+		if current == "" {
+			current = "missing"
+		}
+		latest := e.Latest
+		if e.MajorBehind {
+			latest += " (major)"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", e.Name, current, e.Wanted, latest, e.Type)
+	}
+	return tw.Flush()
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestFindOutdated(t *testing.T) {
+	r, srv := _testRegistry(t, testPackages{
+		"a@1.0.0": nil,
+		"a@1.1.0": nil,
+		"a@2.0.0": nil,
+		"b@1.0.0": nil,
+		"c@3.0.0": nil,
+		"c@3.2.0": nil,
+		"d@1.0.0": nil,
+		"d@2.0.0": nil,
+	})
+	defer srv.Close()
+
+	//npm lists optional dependencies under dependencies too, but the optional range counts
+	pkg := &Package{
+		Dependencies:         _deps(t, map[string]string{"a": "^1", "b": "^1", "d": "^1"}),
+		DevDependencies:      _deps(t, map[string]string{"c": "^3"}),
+		OptionalDependencies: _deps(t, map[string]string{"d": "^2"}),
+	}
+	current := map[string]string{"a": "1.0.0", "b": "1.0.0", "d": "1.0.0"}
+	result, err := findOutdated(r, pkg, func(name string) string { return current[name] })
+	if err != nil {
+		t.Fatalf("Failed to find outdated dependencies: %s\n", err.Error())
+	}
+	expected := []outdatedEntry{
+		{"a", "dependencies", "1.0.0", "1.1.0", "2.0.0", true},
+		{"c", "devDependencies", "", "3.2.0", "3.2.0", false},
+		{"d", "optionalDependencies", "1.0.0", "2.0.0", "2.0.0", true},
+	}
+	if len(result) != len(expected) {
+		t.Fatalf("Expected %d outdated dependencies but got %d: %v\n", len(expected), len(result), result)
+	}
+	for i := range expected {
+		if result[i] != expected[i] {
+			t.Errorf("Expected %v but got %v", expected[i], result[i])
+		}
+	}
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+func cmdPack(args []string) error {
+	fs, o := newFlagSet("pack")
+	dest := fs.String("dest", ".", "`dir`ectory to write the tarball to")
+	pos, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(pos) > 0 {
+		return errors.New("Unexpected argument: " + pos[0])
+	}
+	err = o.setup()
+	if err != nil {
+		return err
+	}
+
+	res, err := Pack(o.dir, *dest)
+	if err != nil {
+		return err
+	}
+	if o.json {
+		return printJSON(res)
+	}
+	for _, f := range res.Files {
+		fmt.Println(f)
+	}
+	fmt.Println()
+	fmt.Println("shasum:", res.Shasum)
+	fmt.Println(res.Filename)
+	return nil
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"fmt"
+)
+
+func cmdRun(args []string) error {
+	fs, o := newFlagSet("run")
+	//everything after "--" goes to the script, flags included
+	var extra []string
+	for i, arg := range args {
+		if arg == "--" {
+			args, extra = args[:i], args[i+1:]
+			break
+		}
+	}
+	pos, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+	err = o.setup()
+	if err != nil {
+		return err
+	}
+	pkg, err := ReadPackage(o.dir)
+	if err != nil {
+		return err
+	}
+
+	if len(pos) == 0 {
+		if o.json {
+			return printJSON(pkg.Scripts)
+		}
+		for _, name := range sortedStringKeys(pkg.Scripts) {
+			fmt.Printf("%s\n  %s\n", name, pkg.Scripts[name])
+		}
+		return nil
+	}
+	//like npm, anything following the script name is passed along too
+	return NewScriptRunner().RunScript(pkg, o.dir, pos[0], append(pos[1:], extra...), !o.ignoreScripts)
+}
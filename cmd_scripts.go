@@ -0,0 +1,75 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+func cmdScripts(args []string) error {
+	fs, o := newFlagSet("scripts")
+	pos, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(pos) > 0 {
+		return errors.New("Unexpected argument: " + pos[0])
+	}
+	err = o.setup()
+	if err != nil {
+		return err
+	}
+	_, tree, err := loadTree(o)
+	if err != nil {
+		return err
+	}
+	pkg, err := ReadPackage(o.dir)
+	if err != nil {
+		return err
+	}
+	policy, err := o.policy(pkg)
+	if err != nil {
+		return err
+	}
+	if policy == nil && !o.json {
+		fmt.Fprintln(os.Stderr, "No script policy, so every package may run its install scripts")
+	}
+
+	type entry struct {
+		Package  string `json:"package"`
+		Location string `json:"location"`
+		Allowed  bool   `json:"allowed"`
+	}
+	entries := make([]entry, 0, 10)
+	tree.Walk(func(n *DependencyNode) {
+		if !n.HasInstallScript && !installedScripts(filepath.Join(o.dir, "node_modules", filepath.FromSlash(n.Path()))) {
+			return
+		}
+		entries = append(entries, entry{n.Name + "@" + n.Version, "node_modules/" + n.Path(), policy.Allows(n.Name, n.Version)})
+	})
+	if o.json {
+		return printJSON(entries)
+	}
+	for _, e := range entries {
+		status := "allowed"
+		if !e.Allowed {
+			status = "blocked"
+		}
+		fmt.Printf("%-8s %s (%s)\n", status, e.Package, e.Location)
+	}
+	return nil
+}
+
+// installedScripts reports if the package installed in dir has install scripts,
+// for lockfiles written before they were recorded
+func installedScripts(dir string) bool {
+	pkg, err := ReadPackage(dir)
+	if err != nil {
+		return false
+	}
+	if _, err := os.Stat(filepath.Join(dir, "binding.gyp")); err == nil {
+		return true
+	}
+	return pkg.hasInstallScript()
+}
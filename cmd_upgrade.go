@@ -0,0 +1,203 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"regexp"
+	"strconv"
+	"text/tabwriter"
+
+	"github.com/blang/semver"
+)
+
+// simpleRange matches the ranges upgrade knows how to rewrite: an optional
+// ^, ~ or = followed by a version with up to three parts, which may be wildcards
+var simpleRange = regexp.MustCompile(`^(\^|~|=)?(v?)(\d+|[xX*])(?:\.(\d+|[xX*]))?(?:\.(\d+|[xX*]))?$`)
+
+// rangeBase returns the lowest version a simple range allows
+func rangeBase(rng string) (semver.Version, bool) {
+	m := simpleRange.FindStringSubmatch(rng)
+	if m == nil || m[3] == "x" || m[3] == "X" || m[3] == "*" {
+		return semver.Version{}, false
+	}
+	parts := make([]uint64, 3)
+	for i, p := range m[3:] {
+		n, err := strconv.ParseUint(p, 10, 64)
+		if err != nil {
+			//wildcards and missing parts allow anything, so start at 0
+			break
+		}
+		parts[i] = n
+	}
+	return semver.Version{Major: parts[0], Minor: parts[1], Patch: parts[2]}, true
+}
+
+// upgradeRange rewrites a simple range to start at a new version, keeping its
+// operator and how many parts it has, e.g. "~1.2" with 2.3.4 gives "~2.3"
+func upgradeRange(rng string, v semver.Version) string {
+	m := simpleRange.FindStringSubmatch(rng)
+	if m == nil {
+		return rng
+	}
+	s := m[1] + m[2]
+	for i, n := range []uint64{v.Major, v.Minor, v.Patch} {
+		p := m[3+i]
+		if p == "" {
+			break
+		}
+		if i > 0 {
+			s += "."
+		}
+		if _, err := strconv.ParseUint(p, 10, 64); err != nil {
+			s += p
+			continue
+		}
+		s += strconv.FormatUint(n, 10)
+	}
+	return s
+}
+
+// upgradeTarget is how far upgrade may move a range: "patch", "minor" or "major"
+func upgradeTarget(base semver.Version, target string) (*SemverRequirements, error) {
+	switch target {
+	case "patch":
+		return NewSemverRequirements(fmt.Sprintf(">=%s <%d.%d.0", base, base.Major, base.Minor+1))
+	case "minor":
+		return NewSemverRequirements(fmt.Sprintf(">=%s <%d.0.0", base, base.Major+1))
+	case "major":
+		return NewSemverRequirements(">=" + base.String())
+	}
+	return nil, errors.New("Unknown upgrade target, expected patch, minor or major: " + target)
+}
+
+type upgradeEntry struct {
+	Name string `json:"-"`
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+// upgradePackage bumps the ranges of the dependencies in a package.json whose names match
+// one of the filters, or all of them without any. Ranges it can't rewrite are left alone.
+func upgradePackage(r *Registry, f *PackageFile, target string, filter []string) ([]upgradeEntry, error) {
+	_, err := upgradeTarget(semver.Version{}, target)
+	if err != nil {
+		return nil, err
+	}
+	result := make([]upgradeEntry, 0, 10)
+	for _, section := range dependencySections {
+		deps, err := f.Section(section)
+		if err != nil {
+			return nil, err
+		}
+		changed := false
+		for _, name := range deps.Keys() {
+			if !matchesFilter(name, filter) {
+				continue
+			}
+			var rng string
+			if json.Unmarshal(deps.Get(name), &rng) != nil {
+				continue
+			}
+			base, ok := rangeBase(rng)
+			if !ok {
+				continue
+			}
+			req, err := upgradeTarget(base, target)
+			if err != nil {
+				return nil, err
+			}
+			v, err := r.LatestCompatablePackageVersion(name, req)
+			if err != nil {
+				return nil, err
+			}
+			next := upgradeRange(rng, v)
+			if next == rng {
+				continue
+			}
+			data, err := marshalRaw(next)
+			if err != nil {
+				return nil, err
+			}
+			deps.Set(name, data)
+			changed = true
+			result = append(result, upgradeEntry{name, rng, next})
+		}
+		if changed {
+			err = f.SetSection(section, deps)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	return result, nil
+}
+
+func matchesFilter(name string, filter []string) bool {
+	if len(filter) == 0 {
+		return true
+	}
+	for _, pattern := range filter {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func cmdUpgrade(args []string) error {
+	fs, o := newFlagSet("upgrade")
+	filter := make(listFlag)
+	fs.Var(filter, "filter", "comma separated package `names` or globs to upgrade, instead of all of them")
+	target := fs.String("target", "minor", "how far to upgrade: `patch`, minor or major")
+	pos, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(pos) > 0 {
+		return errors.New("Unexpected argument: " + pos[0])
+	}
+	err = o.setup()
+	if err != nil {
+		return err
+	}
+
+	f, err := ReadPackageFile(o.dir)
+	if err != nil {
+		return err
+	}
+	result, err := upgradePackage(o.registryClient(), f, *target, sortedBoolKeys(filter))
+	if err != nil {
+		return err
+	}
+	if len(result) > 0 {
+		err = f.Write()
+		if err != nil {
+			return err
+		}
+	}
+
+	if o.json {
+		m := make(map[string]upgradeEntry, len(result))
+		for _, e := range result {
+			m[e.Name] = e
+		}
+		return printJSON(m)
+	}
+	if len(result) == 0 {
+		fmt.Println("All dependencies are up to date")
+		return nil
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	for _, e := range result {
+		fmt.Fprintf(tw, "%s\t%s\t→\t%s\n", e.Name, e.From, e.To)
+	}
+	err = tw.Flush()
+	if err != nil {
+		return err
+	}
+	fmt.Println("\nRun fpm install to update the lockfile and node_modules")
+	return nil
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestUpgradePackage(t *testing.T) {
+	r, srv := _testRegistry(t, testPackages{
+		"a@1.0.0": nil,
+		"a@1.2.0": nil,
+		"a@2.1.0": nil,
+		"b@1.0.0": nil,
+		"b@1.0.5": nil,
+		"b@1.1.0": nil,
+		"c@1.0.0": nil,
+		"c@2.0.0": nil,
+		"d@1.0.0": nil,
+		"d@5.0.0": nil,
+		"e@1.0.0": nil,
+		"e@1.3.0": nil,
+	})
+	defer srv.Close()
+
+	check := func(target string, filter []string, expected map[string]string) {
+		f, dir := _testPackageFile(t, testPackageJSON)
+		defer os.RemoveAll(dir)
+		result, err := upgradePackage(r, f, target, filter)
+		if err != nil {
+			t.Fatalf("Failed to upgrade: %s\n", err.Error())
+		}
+		found := make(map[string]string, len(result))
+		for _, e := range result {
+			found[e.Name] = e.To
+		}
+		for name, rng := range expected {
+			if found[name] != rng {
+				t.Errorf("%s: expected %s to be upgraded to '%s' but got '%s'", target, name, rng, found[name])
+			}
+		}
+		for name, rng := range found {
+			if _, ok := expected[name]; !ok {
+				t.Errorf("%s: unexpected upgrade of %s to '%s'", target, name, rng)
+			}
+		}
+	}
+	check("patch", nil, map[string]string{"b": "~1.0.5"})
+	check("minor", nil, map[string]string{"a": "^1.2.0", "b": "~1.1.0", "e": "1.3.0"})
+	check("major", nil, map[string]string{"a": "^2.1.0", "b": "~1.1.0", "c": "2.x", "e": "1.3.0"})
+	check("major", []string{"a", "e*"}, map[string]string{"a": "^2.1.0", "e": "1.3.0"})
+
+	//order and the rest of the file stay as they were
+	f, dir := _testPackageFile(t, testPackageJSON)
+	defer os.RemoveAll(dir)
+	_, err := upgradePackage(r, f, "minor", []string{"a"})
+	if err != nil {
+		t.Fatalf("Failed to upgrade: %s\n", err.Error())
+	}
+	err = f.Write()
+	if err != nil {
+		t.Fatalf("Failed to write package.json: %s\n", err.Error())
+	}
+	data, err := ioutil.ReadFile(f.Path)
+	if err != nil {
+		t.Fatalf("Failed to read package.json: %s\n", err.Error())
+	}
+	expected := strings.Replace(testPackageJSON, `"a": "^1.0.0"`, `"a": "^1.2.0"`, 1)
+	if string(data) != expected {
+		t.Errorf("Expected package.json:\n%s\nbut got:\n%s", expected, string(data))
+	}
+}
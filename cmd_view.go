@@ -0,0 +1,77 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// splitSpec splits a "name@range" argument, keeping the '@' of scoped names
+func splitSpec(spec string) (name, rng string) {
+	i := strings.LastIndex(spec, "@")
+	if i <= 0 {
+		return spec, ""
+	}
+	return spec[:i], spec[i+1:]
+}
+
+func cmdView(args []string) error {
+	fs, o := newFlagSet("view")
+	pos, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(pos) != 1 {
+		fs.Usage()
+		return errors.New("Expected a single package")
+	}
+	err = o.setup()
+	if err != nil {
+		return err
+	}
+
+	name, rng := splitSpec(pos[0])
+	req, err := NewSemverRequirements(rng)
+	if err != nil {
+		return err
+	}
+	r := o.registryClient()
+	vers, err := r.LatestCompatablePackageVersion(name, req)
+	if err != nil {
+		return err
+	}
+	pkg, err := r.PackageByVersion(name, vers.String())
+	if err != nil {
+		return err
+	}
+	if o.json {
+		return printJSON(pkg)
+	}
+	tags, err := r.PackageTags(name)
+	if err != nil {
+		return err
+	}
+
+	fmt.Println(pkg.Name + "@" + pkg.Version)
+	if pkg.Description != "" {
+		fmt.Println(pkg.Description)
+	}
+	fmt.Println()
+	fmt.Println("tarball:", pkg.Dist.Tarball)
+	fmt.Println("shasum: ", pkg.Dist.Shasum)
+	if len(pkg.Dependencies) > 0 {
+		fmt.Println()
+		fmt.Println("dependencies:")
+		for _, k := range sortedReqKeys(pkg.Dependencies) {
+			fmt.Printf("  %s: %s\n", k, pkg.Dependencies[k].Range())
+		}
+	}
+	if len(tags) > 0 {
+		fmt.Println()
+		fmt.Println("dist-tags:")
+		for _, k := range sortedStringKeys(tags) {
+			fmt.Printf("  %s: %s\n", k, tags[k])
+		}
+	}
+	return nil
+}
@@ -5,15 +5,114 @@ import (
 	"sort"
 )
 
+// kinds of dependency edges
+const (
+	depProd = iota
+	depDev
+	depOptional
+	depPeer
+)
+
 type DependencyTree struct {
-	Nodes map[string]DependencyNode
+	Requires         map[string]string
+	DevRequires      map[string]string
+	OptionalRequires map[string]string
+	Nodes            map[string]*DependencyNode
+	PeerConflicts    []PeerConflict
 }
 type DependencyNode struct {
-	Name    string
-	Version string
-	Tarball string
-	Shasum  string
-	Nodes   map[string]DependencyNode
+	Name             string
+	Version          string
+	Tarball          string
+	Shasum           string
+	Integrity        string
+	Requires         map[string]string
+	OptionalRequires map[string]string
+	PeerRequires     map[string]string
+	Nodes            map[string]*DependencyNode
+
+	//set when the node is only in the tree because of
+	//dev, optional or peer dependencies respectively
+	Dev      bool
+	Optional bool
+	Peer     bool
+
+	//set when an override forced the range the node was picked for
+	Overridden bool
+
+	//set when the package runs scripts when installed
+	HasInstallScript bool
+
+	//deprecation message from the registry
+	Deprecated string `json:"-"`
+
+	//optional dependencies are kept for every platform, and only
+	//left out by the installer when they don't support its own
+	PlatformSupport
+
+	//nil for nodes placed at the root of the tree
+	Parent *DependencyNode `json:"-"`
+}
+
+// A DependencyEdge is a single step of a dependency path, From being nil for the root
+type DependencyEdge struct {
+	From  *DependencyNode
+	To    *DependencyNode
+	Range string
+	Kind  int
+}
+
+// requires returns the dependencies of a kind declared by the root package
+func (n *DependencyTree) requires(kind int) map[string]string {
+	switch kind {
+	case depProd:
+		return n.Requires
+	case depDev:
+		return n.DevRequires
+	case depOptional:
+		return n.OptionalRequires
+	}
+	return nil
+}
+
+// requires returns the dependencies of a kind declared by the node
+func (n *DependencyNode) requires(kind int) map[string]string {
+	switch kind {
+	case depProd:
+		return n.Requires
+	case depOptional:
+		return n.OptionalRequires
+	case depPeer:
+		return n.PeerRequires
+	}
+	return nil
+}
+
+// requirement returns the range a node declares for a dependency of any kind
+func (n *DependencyNode) requirement(name string) (string, bool) {
+	for _, kind := range []int{depProd, depOptional, depPeer} {
+		if rng, ok := n.requires(kind)[name]; ok {
+			return rng, true
+		}
+	}
+	return "", false
+}
+
+func (n *DependencyNode) label() string {
+	l := n.Name + "@" + n.Version
+	if n.Dev {
+		l += " (dev)"
+	}
+	if n.Optional {
+		l += " (optional)"
+	}
+	if n.Peer {
+		l += " (peer)"
+	}
+	if n.Overridden {
+		l += " (overridden)"
+	}
+	return l
 }
 
 func (n *DependencyTree) Print(w io.Writer) {
@@ -28,11 +127,11 @@ func (n *DependencyTree) Print(w io.Writer) {
 }
 func (n *DependencyNode) Print(prefix string, last bool, w io.Writer) {
 	if last {
-		io.WriteString(w, prefix+"└── "+n.Name+"@"+n.Version+"\n")
-		prefix = prefix + "    "
+		io.WriteString(w, prefix+"└── "+n.label()+"\n")
+		prefix = prefix + "    "
 	} else {
-		io.WriteString(w, prefix+"├── "+n.Name+"@"+n.Version+"\n")
-		prefix = prefix + "│   "
+		io.WriteString(w, prefix+"├── "+n.label()+"\n")
+		prefix = prefix + "│   "
 	}
 	keys := sortedDepKeys(n.Nodes)
 	i := 0
@@ -42,7 +141,7 @@ func (n *DependencyNode) Print(prefix string, last bool, w io.Writer) {
 		v.Print(prefix, i == len(keys), w)
 	}
 }
-func sortedDepKeys(m map[string]DependencyNode) []string {
+func sortedDepKeys(m map[string]*DependencyNode) []string {
 	keys := make([]string, 0, len(m))
 	for k := range m {
 		keys = append(keys, k)
@@ -50,20 +149,311 @@ func sortedDepKeys(m map[string]DependencyNode) []string {
 	sort.Strings(keys)
 	return keys
 }
+func sortedReqKeys(m DependencyMap) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+func sortedStringKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Path returns the node_modules relative path of the node, e.g. "a/node_modules/b"
+func (n *DependencyNode) Path() string {
+	if n.Parent == nil {
+		return n.Name
+	}
+	return n.Parent.Path() + "/node_modules/" + n.Name
+}
+
+// Walk calls fn for every node in the tree, parents before children and siblings sorted by name
+func (n *DependencyTree) Walk(fn func(*DependencyNode)) {
+	var walk func(map[string]*DependencyNode)
+	walk = func(nodes map[string]*DependencyNode) {
+		for _, k := range sortedDepKeys(nodes) {
+			fn(nodes[k])
+			walk(nodes[k].Nodes)
+		}
+	}
+	walk(n.Nodes)
+}
+
+// Resolve finds the node that `name` would resolve to when required from `from`,
+// following the node module lookup rules. A nil `from` means the root.
+func (n *DependencyTree) Resolve(from *DependencyNode, name string) *DependencyNode {
+	for p := from; p != nil; p = p.Parent {
+		if p.Nodes[name] != nil {
+			return p.Nodes[name]
+		}
+	}
+	return n.Nodes[name]
+}
+
+// nodesAt returns the child map for a placement level, nil being the root
+func (n *DependencyTree) nodesAt(level *DependencyNode) map[string]*DependencyNode {
+	if level == nil {
+		return n.Nodes
+	}
+	return level.Nodes
+}
+
+// shadows reports if placing a node of `version` at `level` would change
+// the resolution of an already settled dependency below that level to
+// a version it does not accept. Dependencies that don't resolve to anything
+// yet are still pending and will pick up whatever ends up being placed.
+func (n *DependencyTree) shadows(level *DependencyNode, name string, version string) bool {
+	sv, err := parseDown(version)
+	if err != nil {
+		return true
+	}
+	accepts := func(rng string) bool {
+		req, err := NewSemverRequirements(rng)
+		return err != nil || req.SatisfiedBy(sv)
+	}
+	if level != nil {
+		if rng, ok := level.requirement(name); ok && n.Resolve(level, name) != nil && !accepts(rng) {
+			return true
+		}
+	}
+	var check func(map[string]*DependencyNode) bool
+	check = func(nodes map[string]*DependencyNode) bool {
+		for _, c := range nodes {
+			if rng, ok := c.requirement(name); ok && c.Nodes[name] == nil && n.Resolve(c, name) != nil && !accepts(rng) {
+				return true
+			}
+			//a nested copy hides anything placed above it
+			if c.Nodes[name] != nil {
+				continue
+			}
+			if check(c.Nodes) {
+				return true
+			}
+		}
+		return false
+	}
+	return check(n.nodesAt(level))
+}
+
+// place finds the highest level on the path of `parent` where a node can be put
+// without breaking the resolution of anything else, preferring the root.
+// It returns false if a conflicting copy already sits at the `parent` level.
+func (n *DependencyTree) place(parent *DependencyNode, node *DependencyNode) bool {
+	chain := make([]*DependencyNode, 0, 8)
+	for p := parent; p != nil; p = p.Parent {
+		chain = append(chain, p)
+	}
+	//levels ordered from root down to the parent
+	levels := make([]*DependencyNode, 0, len(chain)+1)
+	levels = append(levels, nil)
+	for i := len(chain) - 1; i >= 0; i-- {
+		levels = append(levels, chain[i])
+	}
+
+	//can't go above an existing copy, since it would shadow ours
+	start := 0
+	for i, l := range levels {
+		if n.nodesAt(l)[node.Name] != nil {
+			start = i + 1
+		}
+	}
+	if start == len(levels) {
+		return false
+	}
+	target := parent
+	for i := start; i < len(levels); i++ {
+		if !n.shadows(levels[i], node.Name, node.Version) {
+			target = levels[i]
+			break
+		}
+	}
+
+	node.Parent = target
+	n.nodesAt(target)[node.Name] = node
+	return true
+}
+
+// reachable returns the nodes that can be reached following only the given kinds
+// of dependencies, starting from the root's dependencies of `rootKinds`
+func (n *DependencyTree) reachable(rootKinds []int, kinds []int) map[*DependencyNode]bool {
+	seen := make(map[*DependencyNode]bool, 100)
+	var visit func(from *DependencyNode, reqs map[string]string)
+	visit = func(from *DependencyNode, reqs map[string]string) {
+		for name := range reqs {
+			c := n.Resolve(from, name)
+			if c == nil || seen[c] {
+				continue
+			}
+			seen[c] = true
+			for _, kind := range kinds {
+				visit(c, c.requires(kind))
+			}
+		}
+	}
+	for _, kind := range rootKinds {
+		visit(nil, n.requires(kind))
+	}
+	return seen
+}
 
-func CalculateTree(r *Registry, deps DependencyMap) (*DependencyTree, error) {
-	t := new(DependencyTree)
-	r.cacheAll(deps)
-	for name, req := range deps {
-		vers, err := r.LatestCompatablePackageVersion(name, req)
-		if err != nil {
-			return nil, err
+// edges returns the resolved dependencies of a node, or of the root if nil, sorted by name
+func (n *DependencyTree) edges(from *DependencyNode) []DependencyEdge {
+	result := make([]DependencyEdge, 0, 10)
+	for _, kind := range []int{depProd, depDev, depOptional, depPeer} {
+		var reqs map[string]string
+		if from == nil {
+			reqs = n.requires(kind)
+		} else {
+			reqs = from.requires(kind)
 		}
-		pkg, err := r.PackageByVersion(name, vers.String())
-		if err != nil {
-			return nil, err
+		for _, name := range sortedStringKeys(reqs) {
+			to := n.Resolve(from, name)
+			if to != nil {
+				result = append(result, DependencyEdge{from, to, reqs[name], kind})
+			}
 		}
-		t.Nodes[name] = DependencyNode{name, vers.String(), pkg.Dist.Tarball, pkg.Dist.Shasum, map[string]DependencyNode{}}
 	}
-	return t, nil
+	return result
+}
+
+// PathTo returns the shortest chain of dependencies leading from the root to a node
+func (n *DependencyTree) PathTo(target *DependencyNode) []DependencyEdge {
+	if target == nil {
+		return nil
+	}
+	prev := make(map[*DependencyNode]DependencyEdge, 100)
+	queue := []*DependencyNode{nil}
+	for len(queue) > 0 {
+		from := queue[0]
+		queue = queue[1:]
+		for _, e := range n.edges(from) {
+			if _, ok := prev[e.To]; ok {
+				continue
+			}
+			prev[e.To] = e
+			if e.To == target {
+				path := make([]DependencyEdge, 0, 10)
+				for c := target; c != nil; c = prev[c].From {
+					path = append([]DependencyEdge{prev[c]}, path...)
+				}
+				return path
+			}
+			queue = append(queue, e.To)
+		}
+	}
+	return nil
+}
+
+// maxPaths bounds how many paths PathsTo returns, since heavily shared packages can have a huge number
+const maxPaths = 1000
+
+// PathsTo returns every chain of dependencies leading from the root to a node
+// without going through the same node twice, shortest first. Past maxPaths only
+// the shortest ones are kept, and truncated is set.
+func (n *DependencyTree) PathsTo(target *DependencyNode) (paths [][]DependencyEdge, truncated bool) {
+	edges := make(map[*DependencyNode][]DependencyEdge, 100)
+	edges[nil] = n.edges(nil)
+	n.Walk(func(node *DependencyNode) {
+		edges[node] = n.edges(node)
+	})
+
+	//only bother following nodes that lead to the target, and only when
+	//they can get there within the length of path being looked for
+	dist := map[*DependencyNode]int{target: 0}
+	for changed := true; changed; {
+		changed = false
+		for from, es := range edges {
+			for _, e := range es {
+				d, ok := dist[e.To]
+				if !ok || e.To == from {
+					continue
+				}
+				if cur, ok := dist[from]; from != target && (!ok || d+1 < cur) {
+					dist[from] = d + 1
+					changed = true
+				}
+			}
+		}
+	}
+	if _, ok := dist[nil]; !ok {
+		return nil, false
+	}
+
+	paths = make([][]DependencyEdge, 0, 10)
+	onPath := make(map[*DependencyNode]bool, 10)
+	var walk func(from *DependencyNode, path []DependencyEdge, left int)
+	walk = func(from *DependencyNode, path []DependencyEdge, left int) {
+		for _, e := range edges[from] {
+			if len(paths) > maxPaths {
+				return
+			}
+			if d, ok := dist[e.To]; !ok || d > left-1 || onPath[e.To] {
+				continue
+			}
+			p := append(path[:len(path):len(path)], e)
+			if e.To == target {
+				if left == 1 {
+					paths = append(paths, p)
+				}
+				continue
+			}
+			onPath[e.To] = true
+			walk(e.To, p, left-1)
+			onPath[e.To] = false
+		}
+	}
+	//a path can't be longer than the number of nodes on it, and looking for
+	//each length in turn keeps the shortest ones when there are too many
+	for length := dist[nil]; length < len(dist) && len(paths) <= maxPaths; length++ {
+		walk(nil, nil, length)
+	}
+	if len(paths) > maxPaths {
+		return paths[:maxPaths], true
+	}
+	return paths, false
+}
+
+// formatPath renders a dependency path like "(root) > a@1.0.0 (^1) > b@2.0.0 (~2.0)"
+func formatPath(path []DependencyEdge) string {
+	s := "(root)"
+	for _, e := range path {
+		s += " > " + e.To.Name + "@" + e.To.Version + " (" + e.Range + ")"
+	}
+	return s
+}
+
+// prune removes every node nothing depends on anymore
+func (n *DependencyTree) prune() {
+	keep := n.reachable([]int{depProd, depDev, depOptional}, []int{depProd, depOptional, depPeer})
+	var prune func(map[string]*DependencyNode)
+	prune = func(nodes map[string]*DependencyNode) {
+		for k, c := range nodes {
+			if !keep[c] {
+				delete(nodes, k)
+				continue
+			}
+			prune(c.Nodes)
+		}
+	}
+	prune(n.Nodes)
+}
+
+// markFlags sets the Dev, Optional and Peer flags of every node
+// that can only be reached through those kinds of dependencies
+func (n *DependencyTree) markFlags() {
+	notDev := n.reachable([]int{depProd, depOptional}, []int{depProd, depOptional, depPeer})
+	notOptional := n.reachable([]int{depProd, depDev}, []int{depProd, depPeer})
+	notPeer := n.reachable([]int{depProd, depDev, depOptional}, []int{depProd, depOptional})
+	n.Walk(func(c *DependencyNode) {
+		c.Dev = !notDev[c]
+		c.Optional = !notOptional[c]
+		c.Peer = !notPeer[c]
+	})
 }
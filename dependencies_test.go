@@ -0,0 +1,503 @@
+package main
+
+import (
+	"bytes"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func _treeCheck(t *testing.T, tree *DependencyTree, expected map[string]string) {
+	found := make(map[string]string, len(expected))
+	tree.Walk(func(n *DependencyNode) {
+		found[n.Path()] = n.Version
+	})
+	for path, version := range expected {
+		if found[path] != version {
+			t.Errorf("Expected '%s' at version '%s' but got '%s'", path, version, found[path])
+		}
+	}
+	for path, version := range found {
+		if _, ok := expected[path]; !ok {
+			t.Errorf("Unexpected node '%s' at version '%s'", path, version)
+		}
+	}
+	if t.Failed() {
+		var buf bytes.Buffer
+		tree.Print(&buf)
+		t.Log("\n" + buf.String())
+	}
+}
+
+func _deps(t *testing.T, m map[string]string) DependencyMap {
+	deps := make(DependencyMap, len(m))
+	for k, v := range m {
+		req, err := NewSemverRequirements(v)
+		if err != nil {
+			t.Fatalf("Bad test, failed to parse requirement '%s': %s\n", v, err.Error())
+		}
+		deps[k] = req
+	}
+	return deps
+}
+
+func TestCalculateTree_hoisting(t *testing.T) {
+	r, srv := _testRegistry(t, testPackages{
+		"a@1.0.0": {"c": "^1.0.0"},
+		"b@1.0.0": {"c": "^2.0.0"},
+		"c@1.0.0": nil,
+		"c@1.1.0": nil,
+		"c@2.0.0": nil,
+	})
+	defer srv.Close()
+
+	tree, err := CalculateTree(r, &Package{Dependencies: _deps(t, map[string]string{"a": "^1", "b": "^1"})}, ResolveOptions{})
+	if err != nil {
+		t.Fatalf("Failed to calculate tree: %s\n", err.Error())
+	}
+	_treeCheck(t, tree, map[string]string{
+		"a":                "1.0.0",
+		"b":                "1.0.0",
+		"c":                "1.1.0",
+		"b/node_modules/c": "2.0.0",
+	})
+}
+
+func TestCalculateTree_shadowing(t *testing.T) {
+	r, srv := _testRegistry(t, testPackages{
+		"x@1.0.0": {"y": "^1.0.0"},
+		"y@1.0.0": {"z": "^1.0.0"},
+		"z@1.0.0": nil,
+		"z@2.0.0": nil,
+	})
+	defer srv.Close()
+
+	tree, err := CalculateTree(r, &Package{Dependencies: _deps(t, map[string]string{"x": "1", "z": "2"})}, ResolveOptions{})
+	if err != nil {
+		t.Fatalf("Failed to calculate tree: %s\n", err.Error())
+	}
+	_treeCheck(t, tree, map[string]string{
+		"x":                "1.0.0",
+		"y":                "1.0.0",
+		"z":                "2.0.0",
+		"y/node_modules/z": "1.0.0",
+	})
+	if tree.Resolve(tree.Nodes["y"], "z").Version != "1.0.0" {
+		t.Errorf("Expected y to resolve z to '1.0.0'")
+	}
+}
+
+func TestCalculateTree_cycle(t *testing.T) {
+	r, srv := _testRegistry(t, testPackages{
+		"d@1.0.0": {"e": "^1.0.0"},
+		"e@1.0.0": {"d": "^1.0.0"},
+	})
+	defer srv.Close()
+
+	tree, err := CalculateTree(r, &Package{Dependencies: _deps(t, map[string]string{"d": "^1"})}, ResolveOptions{})
+	if err != nil {
+		t.Fatalf("Failed to calculate tree: %s\n", err.Error())
+	}
+	_treeCheck(t, tree, map[string]string{
+		"d": "1.0.0",
+		"e": "1.0.0",
+	})
+}
+
+func TestCalculateTree_kinds(t *testing.T) {
+	r, srv := _testRegistry(t, testPackages{
+		"app@1.0.0":     {"shared": "^1.0.0"},
+		"tool@1.0.0":    {"shared": "^1.0.0", "devonly": "^1.0.0"},
+		"shared@1.0.0":  nil,
+		"devonly@1.0.0": nil,
+		"native@1.0.0":  {"missing": "^1.0.0"},
+	})
+	defer srv.Close()
+
+	root := &Package{
+		Dependencies:         _deps(t, map[string]string{"app": "^1"}),
+		DevDependencies:      _deps(t, map[string]string{"tool": "^1"}),
+		OptionalDependencies: _deps(t, map[string]string{"native": "^1", "gone": "^1"}),
+	}
+	tree, err := CalculateTree(r, root, ResolveOptions{})
+	if err != nil {
+		t.Fatalf("Failed to calculate tree: %s\n", err.Error())
+	}
+	_treeCheck(t, tree, map[string]string{
+		"app":     "1.0.0",
+		"tool":    "1.0.0",
+		"shared":  "1.0.0",
+		"devonly": "1.0.0",
+	})
+
+	check := func(name string, dev, optional, peer bool) {
+		n := tree.Nodes[name]
+		if n == nil {
+			return
+		}
+		if n.Dev != dev || n.Optional != optional || n.Peer != peer {
+			t.Errorf("Expected %s flags dev=%t optional=%t peer=%t but got dev=%t optional=%t peer=%t",
+				name, dev, optional, peer, n.Dev, n.Optional, n.Peer)
+		}
+	}
+	check("app", false, false, false)
+	check("shared", false, false, false)
+	check("tool", true, false, false)
+	check("devonly", true, false, false)
+}
+
+func TestCalculateTree_sharedWithFailedOptional(t *testing.T) {
+	r, srv := _testRegistry(t, testPackages{
+		"x@1.0.0":  {"a": "^1.0.0"},
+		"a@1.0.0":  {"c": "^1.0.0"},
+		"o@1.0.0":  {"c": "^1.0.0", "missing": "^1.0.0"},
+		"c@1.0.0":  {"d": "^1.0.0"},
+		"d@1.0.0":  nil,
+		"o2@1.0.0": {"c": "^1.0.0"},
+	})
+	defer srv.Close()
+
+	//c gets placed for o, which then fails, but a needs it along with what it depends on
+	root := &Package{
+		Dependencies:         _deps(t, map[string]string{"x": "^1"}),
+		OptionalDependencies: _deps(t, map[string]string{"o": "^1"}),
+	}
+	tree, err := CalculateTree(r, root, ResolveOptions{})
+	if err != nil {
+		t.Fatalf("Failed to calculate tree: %s\n", err.Error())
+	}
+	_treeCheck(t, tree, map[string]string{
+		"x": "1.0.0",
+		"a": "1.0.0",
+		"c": "1.0.0",
+		"d": "1.0.0",
+	})
+
+	//and the same goes for another optional dependency sharing it
+	root = &Package{OptionalDependencies: _deps(t, map[string]string{"o": "^1", "o2": "^1"})}
+	tree, err = CalculateTree(r, root, ResolveOptions{})
+	if err != nil {
+		t.Fatalf("Failed to calculate tree: %s\n", err.Error())
+	}
+	_treeCheck(t, tree, map[string]string{
+		"o2": "1.0.0",
+		"c":  "1.0.0",
+		"d":  "1.0.0",
+	})
+}
+
+func TestCalculateTree_peers(t *testing.T) {
+	r, srv := _testRegistry(t, testPackages{
+		"plugin@1.0.0":  {},
+		"host@1.0.0":    nil,
+		"host@2.0.0":    nil,
+		"old@1.0.0":     {},
+		"wrapper@1.0.0": {"old": "^1.0.0"},
+	})
+	defer srv.Close()
+	//peers aren't part of the fixture format, so patch them in
+	pkg, err := r.PackageByVersion("plugin", "1.0.0")
+	if err != nil {
+		t.Fatalf("Failed to get package: %s\n", err.Error())
+	}
+	pkg.PeerDependencies = _deps(t, map[string]string{"host": "^1.0.0"})
+	pkg, err = r.PackageByVersion("old", "1.0.0")
+	if err != nil {
+		t.Fatalf("Failed to get package: %s\n", err.Error())
+	}
+	pkg.PeerDependencies = _deps(t, map[string]string{"host": "^1.0.0"})
+
+	tree, err := CalculateTree(r, &Package{Dependencies: _deps(t, map[string]string{"plugin": "^1"})}, ResolveOptions{})
+	if err != nil {
+		t.Fatalf("Failed to calculate tree: %s\n", err.Error())
+	}
+	_treeCheck(t, tree, map[string]string{
+		"plugin": "1.0.0",
+		"host":   "1.0.0",
+	})
+	if !tree.Nodes["host"].Peer {
+		t.Errorf("Expected auto-installed host to be flagged as peer")
+	}
+
+	root := &Package{Dependencies: _deps(t, map[string]string{"wrapper": "^1", "host": "^2"})}
+	_, err = CalculateTree(r, root, ResolveOptions{})
+	perr, ok := err.(*PeerConflictError)
+	if !ok {
+		t.Fatalf("Expected a peer conflict error but got: %v\n", err)
+	}
+	if len(perr.Conflicts) != 1 {
+		t.Fatalf("Expected 1 peer conflict but got %d\n", len(perr.Conflicts))
+	}
+	c := perr.Conflicts[0]
+	if c.Package != "old@1.0.0" || c.Name != "host" || c.Range != "^1.0.0" || c.Found != "2.0.0" {
+		t.Errorf("Unexpected peer conflict: %+v", c)
+	}
+	expected := `host@2.0.0 was picked for:
+  (root) > host@2.0.0 (^2)
+but old@1.0.0 has a peer dependency on host@^1.0.0:
+  (root) > wrapper@1.0.0 (^1) > old@1.0.0 (^1.0.0)
+  which accepts >=1.0.0 <2.0.0`
+	if explained := perr.Tree.ExplainPeerConflict(c); explained != expected {
+		t.Errorf("Expected explanation:\n%s\nbut got:\n%s", expected, explained)
+	}
+
+	tree, err = CalculateTree(r, root, ResolveOptions{LegacyPeerDeps: true})
+	if err != nil {
+		t.Fatalf("Failed to calculate tree with legacy peer deps: %s\n", err.Error())
+	}
+	_treeCheck(t, tree, map[string]string{
+		"wrapper": "1.0.0",
+		"old":     "1.0.0",
+		"host":    "2.0.0",
+	})
+}
+
+func TestCalculateTree_overrides(t *testing.T) {
+	r, srv := _testRegistry(t, testPackages{
+		"a@1.0.0": {"c": "^1.0.0"},
+		"b@1.0.0": {"c": "^1.0.0", "d": "^1.0.0"},
+		"c@1.0.0": nil,
+		"c@1.1.0": nil,
+		"c@2.0.0": nil,
+		"d@1.0.0": nil,
+		"d@1.2.0": nil,
+		"e@1.0.0": nil,
+		"e@1.5.0": nil,
+	})
+	defer srv.Close()
+
+	root := &Package{
+		Dependencies: _deps(t, map[string]string{"a": "^1", "b": "^1", "e": "~1.0.0"}),
+		Overrides:    []byte(`{"c": "1.0.0", "b": {"d": "$e"}}`),
+	}
+	tree, err := CalculateTree(r, root, ResolveOptions{})
+	if err != nil {
+		t.Fatalf("Failed to calculate tree: %s\n", err.Error())
+	}
+	_treeCheck(t, tree, map[string]string{
+		"a": "1.0.0",
+		"b": "1.0.0",
+		"c": "1.0.0",
+		"d": "1.0.0",
+		"e": "1.0.0",
+	})
+	if !tree.Nodes["c"].Overridden || !tree.Nodes["d"].Overridden || tree.Nodes["a"].Overridden {
+		t.Errorf("Expected only c and d to be marked as overridden")
+	}
+
+	root.Overrides = nil
+	root.Resolutions = []byte(`{"b/**/d": "1.2.0", "c": "2.0.0"}`)
+	tree, err = CalculateTree(r, root, ResolveOptions{})
+	if err != nil {
+		t.Fatalf("Failed to calculate tree: %s\n", err.Error())
+	}
+	_treeCheck(t, tree, map[string]string{
+		"a": "1.0.0",
+		"b": "1.0.0",
+		"c": "2.0.0",
+		"d": "1.2.0",
+		"e": "1.0.0",
+	})
+
+	root.Resolutions = nil
+	root.Overrides = []byte(`{"e": "^1.5.0"}`)
+	_, err = CalculateTree(r, root, ResolveOptions{})
+	if err == nil {
+		t.Errorf("Expected overriding a direct dependency with a different range to fail")
+	}
+}
+
+func TestCalculateTree_preferLowest(t *testing.T) {
+	r, srv := _testRegistry(t, testPackages{
+		"a@1.0.0": {"c": "^1.1.0"},
+		"a@1.2.0": {"c": "^1.2.0"},
+		"b@1.0.0": {"c": "^1.0.0"},
+		"c@1.0.0": nil,
+		"c@1.1.0": nil,
+		"c@1.2.0": nil,
+	})
+	defer srv.Close()
+
+	root := &Package{Dependencies: _deps(t, map[string]string{"a": "^1", "b": "^1"})}
+	for _, solver := range []bool{false, true} {
+		tree, err := CalculateTree(r, root, ResolveOptions{PreferLowest: true, Solver: solver})
+		if err != nil {
+			t.Fatalf("Failed to calculate tree: %s\n", err.Error())
+		}
+		_treeCheck(t, tree, map[string]string{
+			"a": "1.0.0",
+			"b": "1.0.0",
+			"c": "1.1.0",
+		})
+	}
+}
+
+func TestCalculateTree_deprecated(t *testing.T) {
+	r, srv := _testRegistry(t, testPackages{
+		"a@1.0.0": {"c": "^1.0.0"},
+		"c@1.0.0": nil,
+		"c@1.1.0": nil,
+	})
+	defer srv.Close()
+	pkg, err := r.PackageByVersion("c", "1.1.0")
+	if err != nil {
+		t.Fatalf("Failed to get package: %s\n", err.Error())
+	}
+	pkg.Deprecated = "use 1.0.0"
+
+	root := &Package{Dependencies: _deps(t, map[string]string{"a": "^1"})}
+	tree, err := CalculateTree(r, root, ResolveOptions{})
+	if err != nil {
+		t.Fatalf("Failed to calculate tree: %s\n", err.Error())
+	}
+	if tree.Nodes["c"].Deprecated != "use 1.0.0" {
+		t.Errorf("Expected c to be marked deprecated")
+	}
+
+	for _, solver := range []bool{false, true} {
+		tree, err = CalculateTree(r, root, ResolveOptions{PreferNonDeprecated: true, Solver: solver})
+		if err != nil {
+			t.Fatalf("Failed to calculate tree: %s\n", err.Error())
+		}
+		_treeCheck(t, tree, map[string]string{
+			"a": "1.0.0",
+			"c": "1.0.0",
+		})
+	}
+}
+
+func TestCalculateTree_platform(t *testing.T) {
+	r, srv := _testRegistry(t, testPackages{
+		"tool@1.0.0":       {},
+		"tool-linux@1.0.0": nil,
+		"tool-win@1.0.0":   {"win-helper": "1"},
+		"win-helper@1.0.0": nil,
+	})
+	defer srv.Close()
+	tool, err := r.PackageByVersion("tool", "1.0.0")
+	if err != nil {
+		t.Fatalf("Failed to get package: %s\n", err.Error())
+	}
+	tool.OptionalDependencies = _deps(t, map[string]string{"tool-linux": "1.0.0", "tool-win": "1.0.0"})
+	tool.Engines = engineMap{"node": ">=18"}
+	linux, _ := r.PackageByVersion("tool-linux", "1.0.0")
+	linux.OS = platformList{"linux"}
+	linux.CPU = platformList{"x64", "arm64"}
+	win, _ := r.PackageByVersion("tool-win", "1.0.0")
+	win.OS = platformList{"win32"}
+
+	root := &Package{Dependencies: _deps(t, map[string]string{"tool": "^1"})}
+	opts := ResolveOptions{Target: Platform{Node: "16.0.0", OS: "linux", CPU: "x64"}}
+	for _, solver := range []bool{false, true} {
+		opts.Solver = solver
+		tree, err := CalculateTree(r, root, opts)
+		if err != nil {
+			t.Fatalf("Failed to calculate tree: %s\n", err.Error())
+		}
+		//every platform is kept for the lockfile, the installer picks
+		_treeCheck(t, tree, map[string]string{
+			"tool":       "1.0.0",
+			"tool-linux": "1.0.0",
+			"tool-win":   "1.0.0",
+			"win-helper": "1.0.0",
+		})
+
+		tree = NewLockfile(root, tree).Tree()
+		for _, target := range []Platform{opts.Target, {OS: "win32", CPU: "x64"}} {
+			in := NewInstaller("", nil)
+			in.Platform = target
+			nodes, err := in.nodes(tree)
+			if err != nil {
+				t.Fatalf("Failed to list nodes to install: %s\n", err.Error())
+			}
+			names := make([]string, 0, len(nodes))
+			for _, n := range nodes {
+				names = append(names, n.Name)
+			}
+			//the hoisted dependency of the windows binary goes with it
+			expected := "tool tool-linux"
+			if target.OS == "win32" {
+				expected = "tool tool-win win-helper"
+			}
+			if strings.Join(names, " ") != expected {
+				t.Errorf("Expected %s to be installed for %s but got %s", expected, target.OS, strings.Join(names, " "))
+			}
+		}
+	}
+
+	opts.Solver = false
+	opts.EngineStrict = true
+	_, err = CalculateTree(r, root, opts)
+	if _, ok := err.(*PlatformError); !ok {
+		t.Errorf("Expected a platform error with -engine-strict but got: %v", err)
+	}
+
+	win.OS = platformList{"!linux"}
+	_, err = CalculateTree(r, &Package{Dependencies: _deps(t, map[string]string{"tool-win": "1"})}, opts)
+	if _, ok := err.(*PlatformError); !ok {
+		t.Errorf("Expected a platform error for a required package but got: %v", err)
+	}
+}
+
+func TestDependencyTree_PathsTo(t *testing.T) {
+	r, srv := _testRegistry(t, testPackages{
+		"a@1.0.0": {"b": "^1.0.0", "c": "^1.0.0"},
+		"b@1.0.0": {"c": "~1.0.0"},
+		"c@1.0.0": {"a": "^1.0.0"},
+	})
+	defer srv.Close()
+
+	tree, err := CalculateTree(r, &Package{Dependencies: _deps(t, map[string]string{"a": "^1", "c": "1"})}, ResolveOptions{})
+	if err != nil {
+		t.Fatalf("Failed to calculate tree: %s\n", err.Error())
+	}
+	paths, truncated := tree.PathsTo(tree.Nodes["c"])
+	if truncated {
+		t.Errorf("Expected every path to be returned")
+	}
+	found := make([]string, 0, len(paths))
+	for _, p := range paths {
+		found = append(found, formatPath(p))
+	}
+	expected := []string{
+		"(root) > c@1.0.0 (1)",
+		"(root) > a@1.0.0 (^1) > c@1.0.0 (^1.0.0)",
+		"(root) > a@1.0.0 (^1) > b@1.0.0 (^1.0.0) > c@1.0.0 (~1.0.0)",
+	}
+	if strings.Join(found, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("Expected paths:\n%s\nbut got:\n%s", strings.Join(expected, "\n"), strings.Join(found, "\n"))
+	}
+}
+
+func TestDependencyTree_PathsToTruncated(t *testing.T) {
+	//two packages on each of 11 levels, each depending on both on the next one,
+	//make for 2048 paths to z besides the one straight from the root
+	pkgs := testPackages{"z@1.0.0": nil}
+	for i := 0; i <= 10; i++ {
+		next := map[string]string{"z": "1"}
+		if i < 10 {
+			next = map[string]string{"x" + strconv.Itoa(i+1): "1", "y" + strconv.Itoa(i+1): "1"}
+		}
+		pkgs["x"+strconv.Itoa(i)+"@1.0.0"] = next
+		pkgs["y"+strconv.Itoa(i)+"@1.0.0"] = next
+	}
+	r, srv := _testRegistry(t, pkgs)
+	defer srv.Close()
+
+	tree, err := CalculateTree(r, &Package{Dependencies: _deps(t, map[string]string{"x0": "1", "y0": "1", "z": "1"})}, ResolveOptions{})
+	if err != nil {
+		t.Fatalf("Failed to calculate tree: %s\n", err.Error())
+	}
+	paths, truncated := tree.PathsTo(tree.Nodes["z"])
+	if !truncated || len(paths) != maxPaths {
+		t.Fatalf("Expected %d paths to be kept but got %d (truncated %t)\n", maxPaths, len(paths), truncated)
+	}
+	if p := formatPath(paths[0]); p != "(root) > z@1.0.0 (1)" {
+		t.Errorf("Expected the shortest path to be kept but the first is: %s", p)
+	}
+	for i := 1; i < len(paths); i++ {
+		if len(paths[i]) < len(paths[i-1]) {
+			t.Fatalf("Expected the paths shortest first\n")
+		}
+	}
+}
@@ -0,0 +1,384 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// An Installer puts the packages of a DependencyTree into a project's node_modules
+type Installer struct {
+	Dir   string
+	Cache *Cache
+	Jobs  int
+
+	//kinds of nodes to leave out: "dev", "optional" or "peer"
+	Omit map[string]bool
+
+	//optional packages that don't support it are left out
+	Platform Platform
+
+	//when set, files are hardlinked from the store instead of extracted
+	Store *Store
+
+	//LayoutHoisted or LayoutIsolated, empty being hoisted
+	Layout string
+
+	//install scripts are run with Scripts, or a default ScriptRunner if nil
+	IgnoreScripts bool
+	Scripts       *ScriptRunner
+
+	//when set, packages it doesn't allow don't run their install scripts
+	ScriptPolicy *ScriptPolicy
+}
+
+func NewInstaller(dir string, c *Cache) *Installer {
+	return &Installer{Dir: dir, Cache: c, Jobs: 8, Platform: CurrentPlatform()}
+}
+
+// Install brings node_modules in line with the tree, only touching what differs
+func (in *Installer) Install(t *DependencyTree) error {
+	_, _, err := in.Update(t)
+	return err
+}
+
+// Update changes node_modules to match the tree, reporting how many packages
+// it put in place and removed. What's there is found by scanning node_modules,
+// checked against the state file the last install left. Everything is moved
+// with renames recorded in a journal, so an interrupted update is rolled back
+// by the next one before it starts over, or by Rollback.
+func (in *Installer) Update(t *DependencyTree) (changed int, removed int, err error) {
+	modules := filepath.Join(in.Dir, "node_modules")
+	undone, err := rollback(modules)
+	if err != nil {
+		return 0, 0, err
+	}
+	if undone {
+		log.Warnln("Rolled back an interrupted install, starting over")
+	}
+
+	j, err := openJournal(modules)
+	if err != nil {
+		return 0, 0, err
+	}
+	var fresh []*scriptPackage
+	if in.Layout == LayoutIsolated {
+		changed, removed, fresh, err = in.installIsolated(j, t)
+	} else {
+		changed, removed, fresh, err = in.updateHoisted(j, t)
+	}
+	if err != nil {
+		j.fd.Close()
+		if _, e := rollback(modules); e != nil {
+			log.Errorln("Failed to roll back:", e.Error())
+		}
+		return 0, 0, err
+	}
+	err = j.close()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	err = in.link(t)
+	if err != nil {
+		return 0, 0, err
+	}
+	err = in.runScripts(fresh)
+	if e := settleScripts(modules, fresh); e != nil && err == nil {
+		err = e
+	}
+	return changed, removed, err
+}
+
+// Rollback undoes an interrupted install, reporting if there was one
+func (in *Installer) Rollback() (bool, error) {
+	return rollback(filepath.Join(in.Dir, "node_modules"))
+}
+
+// updateHoisted moves every package that doesn't match the tree into staging, children
+// first so each one holds just its own files, then puts the tree in place parents first,
+// reusing staged packages that moved and extracting the rest
+func (in *Installer) updateHoisted(j *journal, t *DependencyTree) (changed int, removed int, fresh []*scriptPackage, err error) {
+	nodes, err := in.nodes(t)
+	if err != nil {
+		return 0, 0, nil, err
+	}
+	state, err := readState(j.modules)
+	if err != nil {
+		log.Warnln("Ignoring unreadable install state:", err.Error())
+		state = &installState{}
+	}
+	//packages of the isolated layout are all linked from here, so none of them can be kept
+	if _, err := os.Lstat(filepath.Join(j.modules, isolatedDir)); err == nil {
+		err = j.remove(isolatedDir)
+		if err != nil {
+			return 0, 0, nil, err
+		}
+	}
+	current, err := scanModules(j.modules)
+	if err != nil {
+		return 0, 0, nil, err
+	}
+
+	wanted := make(map[string]*DependencyNode, len(nodes))
+	for _, n := range nodes {
+		wanted[n.Path()] = n
+	}
+	kept := make(map[string]bool, len(current))
+	for _, p := range current {
+		n := wanted[p.Path]
+		kept[p.Path] = n != nil && (p.Parent == "" || kept[p.Parent]) &&
+			p.Name == n.Name && p.Version == n.Version && in.trusts(state, p.Path, n)
+	}
+
+	staged := make(map[string][]*installedPackage, 10)
+	for i := len(current) - 1; i >= 0; i-- {
+		p := current[i]
+		if kept[p.Path] {
+			continue
+		}
+		p.Staged = strconv.Itoa(i)
+		log.Debugln("Moving", p.Path, "out of the way")
+		err = j.rename("stash", p.Path, p.Staged)
+		if err != nil {
+			return 0, 0, nil, err
+		}
+		if p.Name != "" {
+			staged[p.Name+"@"+p.Version] = append(staged[p.Name+"@"+p.Version], p)
+			removed++
+		}
+	}
+
+	from := make(map[*DependencyNode]string, len(nodes))
+	moved := make(map[*DependencyNode]bool, 10)
+	extract := make([]*DependencyNode, 0, len(nodes))
+	for i, n := range nodes {
+		if kept[n.Path()] {
+			continue
+		}
+		key := n.Name + "@" + n.Version
+		for k, p := range staged[key] {
+			if in.trusts(state, p.Path, n) {
+				from[n] = p.Staged
+				moved[n] = true
+				staged[key] = append(staged[key][:k], staged[key][k+1:]...)
+				removed--
+				break
+			}
+		}
+		if !moved[n] {
+			from[n] = "new-" + strconv.Itoa(i)
+			extract = append(extract, n)
+		}
+	}
+	err = in.extract(extract, func(n *DependencyNode) string { return j.staged(from[n]) })
+	if err != nil {
+		return 0, 0, nil, err
+	}
+
+	next := &installState{Layout: LayoutHoisted, Packages: make(map[string]installedState, len(nodes))}
+	missing := make(map[*DependencyNode]bool, 10)
+	for _, n := range nodes {
+		if kept[n.Path()] {
+			next.Packages[n.Path()] = state.kept(n.Path(), n)
+			continue
+		}
+		//optional packages that failed to extract take everything inside them along
+		if _, err := os.Stat(j.staged(from[n])); os.IsNotExist(err) || missing[n.Parent] {
+			missing[n] = true
+			continue
+		}
+		if moved[n] {
+			//what was nested inside it has been staged separately
+			err = os.RemoveAll(filepath.Join(j.staged(from[n]), "node_modules"))
+			if err != nil {
+				return 0, 0, nil, err
+			}
+		}
+		err = j.rename("place", n.Path(), from[n])
+		if err != nil {
+			return 0, 0, nil, err
+		}
+		next.Packages[n.Path()] = installedState{Version: n.Version, Shasum: n.Shasum, Pending: !moved[n]}
+		changed++
+		if !moved[n] {
+			p := &scriptPackage{Node: n, Path: n.Path(), Dir: filepath.Join(j.modules, filepath.FromSlash(n.Path()))}
+			for _, e := range t.edges(n) {
+				p.Deps = append(p.Deps, filepath.Join(j.modules, filepath.FromSlash(e.To.Path())))
+			}
+			fresh = append(fresh, p)
+		}
+	}
+	return changed, removed, fresh, j.writeState(next)
+}
+
+// An installedPackage is a folder found in node_modules
+type installedPackage struct {
+	Path string
+
+	//path of the package it's nested in, empty at the top
+	Parent string
+
+	//empty when the folder isn't a package, or not the one its name says
+	Name    string
+	Version string
+
+	//where it was moved to in staging
+	Staged string
+}
+
+// scanModules lists the packages in node_modules, parents before the ones nested in them
+func scanModules(modules string) ([]*installedPackage, error) {
+	result := make([]*installedPackage, 0, 100)
+	var scan func(dir, parent, scope string) error
+	scan = func(dir, parent, scope string) error {
+		infos, err := ioutil.ReadDir(dir)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		for _, info := range infos {
+			if strings.HasPrefix(info.Name(), ".") {
+				continue
+			}
+			if scope == "" && strings.HasPrefix(info.Name(), "@") && info.IsDir() {
+				err = scan(filepath.Join(dir, info.Name()), parent, info.Name())
+				if err != nil {
+					return err
+				}
+				continue
+			}
+			name := path.Join(scope, info.Name())
+			p := &installedPackage{Path: name, Parent: parent}
+			if parent != "" {
+				p.Path = parent + "/node_modules/" + name
+			}
+			result = append(result, p)
+
+			//links and files get replaced, like anything else that isn't a package
+			if !info.IsDir() {
+				continue
+			}
+			pkg, err := ReadPackage(filepath.Join(dir, info.Name()))
+			if err != nil || pkg.Name != name {
+				continue
+			}
+			p.Name, p.Version = pkg.Name, pkg.Version
+			err = scan(filepath.Join(dir, info.Name(), "node_modules"), p.Path, "")
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return result, scan(modules, "", "")
+}
+
+// extract installs the nodes in parallel into the folders dir gives, skipping optional ones that fail
+func (in *Installer) extract(nodes []*DependencyNode, dir func(*DependencyNode) string) error {
+	var wg sync.WaitGroup
+	var mx sync.Mutex
+	var firstErr error
+	sem := make(chan struct{}, in.Jobs)
+	for _, n := range nodes {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(n *DependencyNode) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			err := in.installNode(dir(n), n)
+			if err != nil && n.Optional {
+				log.Warnf("Skipping optional dependency %s@%s: %s", n.Name, n.Version, err.Error())
+				os.RemoveAll(dir(n))
+				return
+			}
+			if err != nil {
+				mx.Lock()
+				if firstErr == nil {
+					firstErr = err
+				}
+				mx.Unlock()
+			}
+		}(n)
+	}
+	wg.Wait()
+	return firstErr
+}
+
+// nodes lists what to install, leaving out omitted kinds and optional
+// packages for other platforms, along with everything inside them and
+// everything only they depend on
+func (in *Installer) nodes(t *DependencyTree) ([]*DependencyNode, error) {
+	skipped := make(map[*DependencyNode]bool, 10)
+	t.Walk(func(n *DependencyNode) {
+		if skipped[n.Parent] || in.omitted(n) {
+			log.Debugln("Omitting", n.Name+"@"+n.Version)
+			skipped[n] = true
+			return
+		}
+		e := in.Platform.checkPlatform(n.Name+"@"+n.Version, n.PlatformSupport)
+		if e != nil && n.Optional {
+			log.Infof("Skipping optional dependency %s@%s: %s", n.Name, n.Version, e.Error())
+			skipped[n] = true
+		}
+	})
+
+	//hoisted packages can be left behind by what was skipped, like the dependencies of fsevents on linux
+	needed := make(map[*DependencyNode]bool, 100)
+	queue := []*DependencyNode{nil}
+	for len(queue) > 0 {
+		from := queue[0]
+		queue = queue[1:]
+		for _, e := range t.edges(from) {
+			if !skipped[e.To] && !needed[e.To] {
+				needed[e.To] = true
+				queue = append(queue, e.To)
+			}
+		}
+	}
+
+	nodes := make([]*DependencyNode, 0, 100)
+	var err error
+	t.Walk(func(n *DependencyNode) {
+		if skipped[n] {
+			return
+		}
+		if !needed[n] {
+			log.Debugln("Skipping", n.Name+"@"+n.Version, "since only skipped packages depend on it")
+			return
+		}
+		e := in.Platform.checkPlatform(n.Name+"@"+n.Version, n.PlatformSupport)
+		if e != nil && err == nil {
+			err = e
+		}
+		nodes = append(nodes, n)
+	})
+	return nodes, err
+}
+
+func (in *Installer) omitted(n *DependencyNode) bool {
+	return (n.Dev && in.Omit["dev"]) || (n.Optional && in.Omit["optional"]) || (n.Peer && in.Omit["peer"])
+}
+
+func (in *Installer) installNode(dest string, n *DependencyNode) error {
+	if in.Store != nil {
+		log.Debugln("Linking", n.Name+"@"+n.Version, "to", dest)
+		return in.Store.Install(n, dest, func() (string, error) {
+			return in.Cache.Tarball(n)
+		})
+	}
+	src, err := in.Cache.Tarball(n)
+	if err != nil {
+		return err
+	}
+	log.Debugln("Extracting", n.Name+"@"+n.Version, "to", dest)
+	return extractTarball(src, dest)
+}
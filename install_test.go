@@ -0,0 +1,467 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// _testDir creates a temp dir, removed when the test ends
+func _testDir(t *testing.T, prefix string) string {
+	dir, err := ioutil.TempDir("", prefix)
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %s\n", err.Error())
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return dir
+}
+
+// _testProject serves pkgs from a test registry and resolves deps against it, for a
+// project in a temp dir. The server and dir are cleaned up when the test ends.
+func _testProject(t *testing.T, pkgs testPackages, deps map[string]string) (*Registry, *httptest.Server, string, *DependencyTree) {
+	r, srv := _testRegistry(t, pkgs)
+	t.Cleanup(srv.Close)
+	dir := _testDir(t, "fpm-project")
+	tree, err := CalculateTree(r, &Package{Dependencies: _deps(t, deps)}, ResolveOptions{})
+	if err != nil {
+		t.Fatalf("Failed to calculate tree: %s\n", err.Error())
+	}
+	return r, srv, dir, tree
+}
+
+func TestInstaller_Install(t *testing.T) {
+	_, _, dir, tree := _testProject(t, testPackages{
+		"a@1.0.0": {"c": "^1.0.0"},
+		"b@1.0.0": {"c": "^2.0.0"},
+		"c@1.0.0": nil,
+		"c@2.0.0": nil,
+	}, map[string]string{"a": "^1", "b": "^1"})
+
+	//round trip through the lockfile, like `ci` does
+	err := NewLockfile(&Package{Name: "root", Version: "1.0.0"}, tree).Write(filepath.Join(dir, LockfileName))
+	if err != nil {
+		t.Fatalf("Failed to write lockfile: %s\n", err.Error())
+	}
+	lock, err := ReadLockfile(filepath.Join(dir, LockfileName))
+	if err != nil {
+		t.Fatalf("Failed to read lockfile: %s\n", err.Error())
+	}
+	err = lock.Satisfies(&Package{Dependencies: _deps(t, map[string]string{"a": "^1", "b": "^1"})})
+	if err != nil {
+		t.Errorf("Expected lockfile to satisfy dependencies: %s", err.Error())
+	}
+	err = lock.Satisfies(&Package{Dependencies: _deps(t, map[string]string{"a": "^2"})})
+	if err == nil {
+		t.Errorf("Expected stale lockfile to be rejected")
+	}
+
+	err = NewInstaller(dir, NewCache(filepath.Join(dir, "cache"))).Install(lock.Tree())
+	if err != nil {
+		t.Fatalf("Failed to install: %s\n", err.Error())
+	}
+	check := func(path, expected string) {
+		data, err := ioutil.ReadFile(filepath.Join(dir, "node_modules", filepath.FromSlash(path), "index.js"))
+		if err != nil {
+			t.Errorf("Failed to read '%s': %s", path, err.Error())
+			return
+		}
+		if string(data) != "module.exports = '"+expected+"'\n" {
+			t.Errorf("Expected '%s' to contain %s but got: %s", path, expected, string(data))
+		}
+	}
+	check("a", "a@1.0.0")
+	check("b", "b@1.0.0")
+	check("c", "c@1.0.0")
+	check("b/node_modules/c", "c@2.0.0")
+}
+
+func TestInstaller_Update(t *testing.T) {
+	r, _, dir, old := _testProject(t, testPackages{
+		"a@1.0.0": {"c": "^1.0.0"},
+		"b@1.0.0": {"c": "^2.0.0"},
+		"c@1.0.0": nil,
+		"c@2.0.0": nil,
+		"d@1.0.0": nil,
+	}, map[string]string{"a": "^1", "b": "^1"})
+	in := NewInstaller(dir, NewCache(filepath.Join(dir, "cache")))
+	err := in.Install(old)
+	if err != nil {
+		t.Fatalf("Failed to install: %s\n", err.Error())
+	}
+	//anything reinstalled would lose this
+	marker := filepath.Join(dir, "node_modules", "a", "marker")
+	err = ioutil.WriteFile(marker, nil, 0644)
+	if err != nil {
+		t.Fatalf("Failed to write marker: %s\n", err.Error())
+	}
+
+	pkg := &Package{Dependencies: _deps(t, map[string]string{"a": "^1", "d": "^1"})}
+	tree, err := CalculateTree(r, pkg, ResolveOptions{Locked: old})
+	if err != nil {
+		t.Fatalf("Failed to calculate tree: %s\n", err.Error())
+	}
+	changed, removed, err := in.Update(tree)
+	if err != nil {
+		t.Fatalf("Failed to update: %s\n", err.Error())
+	}
+	if changed != 1 || removed != 2 {
+		t.Errorf("Expected 1 changed and 2 removed packages but got %d and %d", changed, removed)
+	}
+	if _, err := os.Stat(marker); err != nil {
+		t.Errorf("Expected a to be left alone: %s", err.Error())
+	}
+	for path, exists := range map[string]bool{"a": true, "c": true, "d": true, "b": false} {
+		_, err := os.Stat(filepath.Join(dir, "node_modules", path, "package.json"))
+		if exists && err != nil {
+			t.Errorf("Expected '%s' to be installed: %s", path, err.Error())
+		}
+		if !exists && err == nil {
+			t.Errorf("Expected '%s' to be removed", path)
+		}
+	}
+}
+
+func TestInstaller_Rollback(t *testing.T) {
+	r, _, dir, old := _testProject(t, testPackages{
+		"a@1.0.0": {"c": "^1.0.0"},
+		"b@1.0.0": {"c": "^2.0.0"},
+		"c@1.0.0": nil,
+		"c@2.0.0": nil,
+	}, map[string]string{"a": "^1", "b": "^1"})
+	modules := filepath.Join(dir, "node_modules")
+	in := NewInstaller(dir, NewCache(filepath.Join(dir, "cache")))
+	err := in.Install(old)
+	if err != nil {
+		t.Fatalf("Failed to install: %s\n", err.Error())
+	}
+	err = ioutil.WriteFile(filepath.Join(modules, "b", "node_modules", "c", "marker"), nil, 0644)
+	if err != nil {
+		t.Fatalf("Failed to write marker: %s\n", err.Error())
+	}
+
+	//c@2 gets hoisted once a is gone, and should be moved rather than extracted again
+	tree, err := CalculateTree(r, &Package{Dependencies: _deps(t, map[string]string{"b": "^1"})}, ResolveOptions{Locked: old})
+	if err != nil {
+		t.Fatalf("Failed to calculate tree: %s\n", err.Error())
+	}
+	changed, removed, err := in.Update(tree)
+	if err != nil {
+		t.Fatalf("Failed to update: %s\n", err.Error())
+	}
+	if changed != 1 || removed != 2 {
+		t.Errorf("Expected 1 changed and 2 removed packages but got %d and %d", changed, removed)
+	}
+	if _, err := os.Stat(filepath.Join(modules, "c", "marker")); err != nil {
+		t.Errorf("Expected c to be moved: %s", err.Error())
+	}
+
+	//packages changed by hand don't match the state file and are replaced
+	err = ioutil.WriteFile(filepath.Join(modules, "b", "package.json"), []byte(`{"name":"b","version":"9.9.9"}`), 0644)
+	if err != nil {
+		t.Fatalf("Failed to write package.json: %s\n", err.Error())
+	}
+	changed, _, err = in.Update(tree)
+	if err != nil {
+		t.Fatalf("Failed to update: %s\n", err.Error())
+	}
+	pkg, err := ReadPackage(filepath.Join(modules, "b"))
+	if err != nil {
+		t.Fatalf("Failed to read b: %s\n", err.Error())
+	}
+	if changed != 1 || pkg.Version != "1.0.0" {
+		t.Errorf("Expected b@1.0.0 to be installed again, but got %d changed and version %s", changed, pkg.Version)
+	}
+
+	//an install that stopped halfway through
+	j, err := openJournal(modules)
+	if err != nil {
+		t.Fatalf("Failed to open journal: %s\n", err.Error())
+	}
+	err = j.rename("stash", "c", "0")
+	if err != nil {
+		t.Fatalf("Failed to stash c: %s\n", err.Error())
+	}
+	j.fd.Close()
+	undone, err := in.Rollback()
+	if err != nil {
+		t.Fatalf("Failed to roll back: %s\n", err.Error())
+	}
+	if !undone {
+		t.Errorf("Expected an install to roll back")
+	}
+	if _, err := os.Stat(filepath.Join(modules, "c", "marker")); err != nil {
+		t.Errorf("Expected c to be put back: %s", err.Error())
+	}
+	for _, name := range []string{journalFile, stagingDir} {
+		if _, err := os.Stat(filepath.Join(modules, name)); err == nil {
+			t.Errorf("Expected %s to be removed", name)
+		}
+	}
+}
+
+func TestInstaller_isolated(t *testing.T) {
+	r, _, dir, tree := _testProject(t, testPackages{
+		"a@1.0.0": {"c": "^1.0.0"},
+		"b@1.0.0": {"c": "^2.0.0"},
+		"c@1.0.0": nil,
+		"c@2.0.0": nil,
+	}, map[string]string{"a": "^1", "b": "^1"})
+	in := NewInstaller(dir, NewCache(filepath.Join(dir, "cache")))
+	in.Layout = LayoutIsolated
+	err := in.Install(tree)
+	if err != nil {
+		t.Fatalf("Failed to install: %s\n", err.Error())
+	}
+	check := func(path, expected string) {
+		data, err := ioutil.ReadFile(filepath.Join(dir, "node_modules", filepath.FromSlash(path), "index.js"))
+		if expected == "" {
+			if err == nil {
+				t.Errorf("Expected '%s' not to be visible", path)
+			}
+			return
+		}
+		if err != nil {
+			t.Errorf("Failed to read '%s': %s", path, err.Error())
+			return
+		}
+		if string(data) != "module.exports = '"+expected+"'\n" {
+			t.Errorf("Expected '%s' to contain %s but got: %s", path, expected, string(data))
+		}
+	}
+	check("a", "a@1.0.0")
+	check("b", "b@1.0.0")
+	check(".pnpm/a@1.0.0/node_modules/c", "c@1.0.0")
+	check(".pnpm/b@1.0.0/node_modules/c", "c@2.0.0")
+	//only declared dependencies are visible
+	check("c", "")
+
+	//a package left half extracted by an interrupted install isn't in the state file
+	modules := filepath.Join(dir, "node_modules")
+	state, err := readState(modules)
+	if err != nil || state == nil || len(state.Packages) != 4 {
+		t.Fatalf("Expected a state file listing 4 packages but got %v: %v\n", state, err)
+	}
+	delete(state.Packages, isolatedDir+"/c@1.0.0")
+	err = writeState(modules, state)
+	if err != nil {
+		t.Fatalf("Failed to write state: %s\n", err.Error())
+	}
+	os.Remove(filepath.Join(modules, isolatedDir, "c@1.0.0", "node_modules", "c", "index.js"))
+	changed, removed, err := in.Update(tree)
+	if err != nil {
+		t.Fatalf("Failed to update: %s\n", err.Error())
+	}
+	if changed != 1 || removed != 0 {
+		t.Errorf("Expected only c@1.0.0 to be installed again but got %d changed and %d removed", changed, removed)
+	}
+	check(".pnpm/a@1.0.0/node_modules/c", "c@1.0.0")
+
+	pkg := &Package{Dependencies: _deps(t, map[string]string{"a": "^1"})}
+	next, err := CalculateTree(r, pkg, ResolveOptions{Locked: tree})
+	if err != nil {
+		t.Fatalf("Failed to calculate tree: %s\n", err.Error())
+	}
+	changed, removed, err = in.Update(next)
+	if err != nil {
+		t.Fatalf("Failed to update: %s\n", err.Error())
+	}
+	if changed != 0 || removed != 2 {
+		t.Errorf("Expected 0 changed and 2 removed packages but got %d and %d", changed, removed)
+	}
+	check("a", "a@1.0.0")
+	check("b", "")
+	check(".pnpm/a@1.0.0/node_modules/c", "c@1.0.0")
+
+	//switching back starts over with the hoisted layout
+	in.Layout = LayoutHoisted
+	_, _, err = in.Update(next)
+	if err != nil {
+		t.Fatalf("Failed to update: %s\n", err.Error())
+	}
+	check("c", "c@1.0.0")
+	if _, err := os.Stat(filepath.Join(dir, "node_modules", isolatedDir)); err == nil {
+		t.Errorf("Expected %s to be removed", isolatedDir)
+	}
+}
+
+func TestInstaller_layoutRollback(t *testing.T) {
+	_, srv, dir, tree := _testProject(t, testPackages{
+		"a@1.0.0": {"c": "^1.0.0"},
+		"b@1.0.0": {"c": "^2.0.0"},
+		"c@1.0.0": nil,
+		"c@2.0.0": nil,
+	}, map[string]string{"a": "^1", "b": "^1"})
+	modules := filepath.Join(dir, "node_modules")
+	cache := NewCache(filepath.Join(dir, "cache"))
+	in := NewInstaller(dir, cache)
+	in.Layout = LayoutIsolated
+	err := in.Install(tree)
+	if err != nil {
+		t.Fatalf("Failed to install: %s\n", err.Error())
+	}
+	check := func(layout string) {
+		if _, err := os.Stat(filepath.Join(modules, "a", "index.js")); err != nil {
+			t.Errorf("Expected a to be left in place: %s", err.Error())
+		}
+		state, err := readState(modules)
+		if err != nil || state == nil || state.Layout != layout {
+			t.Errorf("Expected the state of the %s layout to be left in place but got %v: %v", layout, state, err)
+		}
+	}
+
+	//switching to hoisted fails with nothing to fetch from, and has to put .pnpm back
+	srv.Close()
+	in.Cache = NewCache(filepath.Join(dir, "empty"))
+	in.Layout = LayoutHoisted
+	_, _, err = in.Update(tree)
+	if err == nil {
+		t.Fatalf("Expected the update to fail without a registry\n")
+	}
+	check(LayoutIsolated)
+
+	//switching to isolated stops halfway, after the hoisted packages made way for links
+	in.Cache = cache
+	err = in.Install(tree)
+	if err != nil {
+		t.Fatalf("Failed to install: %s\n", err.Error())
+	}
+	in.Layout = LayoutIsolated
+	j, err := openJournal(modules)
+	if err != nil {
+		t.Fatalf("Failed to open journal: %s\n", err.Error())
+	}
+	_, _, _, err = in.installIsolated(j, tree)
+	if err != nil {
+		t.Fatalf("Failed to install: %s\n", err.Error())
+	}
+	j.fd.Close()
+	_, err = in.Rollback()
+	if err != nil {
+		t.Fatalf("Failed to roll back: %s\n", err.Error())
+	}
+	check(LayoutHoisted)
+	if info, err := os.Lstat(filepath.Join(modules, "a")); err != nil || info.Mode()&os.ModeSymlink != 0 {
+		t.Errorf("Expected a to be a folder again")
+	}
+	if _, err := os.Stat(filepath.Join(modules, "b", "node_modules", "c", "index.js")); err != nil {
+		t.Errorf("Expected the nested c to be put back: %s", err.Error())
+	}
+}
+
+func TestInstaller_store(t *testing.T) {
+	_, srv, dir, tree := _testProject(t, testPackages{
+		"a@1.0.0": nil,
+	}, map[string]string{"a": "^1"})
+	store := NewStore(filepath.Join(dir, "store"))
+	install := func(project string) os.FileInfo {
+		//a fresh cache each time, so only the store can save a download
+		in := NewInstaller(filepath.Join(dir, project), NewCache(filepath.Join(dir, project, "cache")))
+		in.Store = store
+		err := in.Install(tree)
+		if err != nil {
+			t.Fatalf("Failed to install %s: %s\n", project, err.Error())
+		}
+		info, err := os.Stat(filepath.Join(dir, project, "node_modules", "a", "index.js"))
+		if err != nil {
+			t.Fatalf("Failed to stat installed file: %s\n", err.Error())
+		}
+		return info
+	}
+	first := install("one")
+
+	//a file changed in place through a project is noticed, and added to the store again
+	fd, err := os.OpenFile(filepath.Join(dir, "one", "node_modules", "a", "index.js"), os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatalf("Failed to open installed file: %s\n", err.Error())
+	}
+	fd.WriteString("changed")
+	fd.Close()
+	second := install("two")
+	if os.SameFile(first, second) {
+		t.Errorf("Expected the changed file to be replaced in the store")
+	}
+	data, err := ioutil.ReadFile(filepath.Join(dir, "two", "node_modules", "a", "index.js"))
+	if err != nil || string(data) != "module.exports = 'a@1.0.0'\n" {
+		t.Errorf("Expected the original contents to be installed, but got: %s", string(data))
+	}
+
+	//so is one changed without its size changing
+	fd, err = os.OpenFile(filepath.Join(dir, "two", "node_modules", "a", "index.js"), os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatalf("Failed to open installed file: %s\n", err.Error())
+	}
+	fd.WriteAt([]byte("M"), 0)
+	fd.Close()
+	third := install("three")
+	if os.SameFile(second, third) {
+		t.Errorf("Expected the file changed in place to be replaced in the store")
+	}
+	data, err = ioutil.ReadFile(filepath.Join(dir, "three", "node_modules", "a", "index.js"))
+	if err != nil || string(data) != "module.exports = 'a@1.0.0'\n" {
+		t.Errorf("Expected the original contents to be installed, but got: %s", string(data))
+	}
+
+	srv.Close()
+	fourth := install("four")
+	if !os.SameFile(third, fourth) {
+		t.Errorf("Expected both projects to link the same file from the store")
+	}
+
+	//the same name and version with another tarball doesn't share the index
+	other := *tree.Nodes["a"]
+	other.Integrity = "sha512-" + strings.Repeat("A", 86) + "=="
+	if _, err := store.index(&other); !os.IsNotExist(err) {
+		t.Errorf("Expected no index for a tarball with another integrity")
+	}
+}
+
+func TestInstaller_Pipeline(t *testing.T) {
+	root := &Package{
+		Dependencies:    _deps(t, map[string]string{"a": "^1"}),
+		DevDependencies: _deps(t, map[string]string{"e": "^1"}),
+	}
+	for _, solver := range []bool{false, true} {
+		r, srv := _testRegistry(t, testPackages{
+			"a@1.0.0": {"b": "^1.0.0", "c": "^1.0.0"},
+			"b@1.0.0": {"c": "^1.0.0", "d": "^1.0.0"},
+			"c@1.0.0": nil,
+			"d@1.0.0": nil,
+			"e@1.0.0": {"f": "^1.0.0"},
+			"f@1.0.0": nil,
+		})
+		defer srv.Close()
+		dir := _testDir(t, "fpm-pipeline")
+		in := NewInstaller(dir, NewCache(filepath.Join(dir, "cache")))
+		in.Store = NewStore(filepath.Join(dir, "store"))
+		in.Omit = map[string]bool{"dev": true}
+		//a single fetcher with a short queue has the resolver wait on it
+		in.Jobs = 1
+		p := in.Pipeline()
+		tree, err := CalculateTree(r, root, ResolveOptions{Settled: p.Add, Solver: solver})
+		p.Wait()
+		if err != nil {
+			t.Fatalf("Failed to calculate tree: %s\n", err.Error())
+		}
+
+		//everything should be in the store by now, but the omitted dev dependencies
+		for _, n := range tree.Nodes {
+			_, err := in.Store.index(n)
+			if n.Dev != os.IsNotExist(err) {
+				t.Errorf("Expected only dev dependencies to be left out of the store, but %s isn't (solver %t)", n.Name, solver)
+			}
+		}
+		srv.Close()
+		err = in.Install(tree)
+		if err != nil {
+			t.Fatalf("Failed to install: %s\n", err.Error())
+		}
+		for _, name := range []string{"a", "b", "c", "d"} {
+			if _, err := os.Stat(filepath.Join(dir, "node_modules", name, "index.js")); err != nil {
+				t.Errorf("Expected '%s' to be installed: %s", name, err.Error())
+			}
+		}
+	}
+}
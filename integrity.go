@@ -0,0 +1,95 @@
+package main
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"hash"
+	"io"
+	"strings"
+)
+
+// hashes supported in integrity strings, strongest first
+var integrityHashes = []struct {
+	algo string
+	new  func() hash.Hash
+}{
+	{"sha512", sha512.New},
+	{"sha384", sha512.New384},
+	{"sha256", sha256.New},
+	{"sha1", sha1.New},
+}
+
+// An integrity is a single hash of a tarball, as found in subresource integrity
+// strings like "sha512-<base64>" that the registry and lockfiles use
+type integrity struct {
+	algo   string
+	digest []byte
+}
+
+// nodeIntegrity picks the strongest hash known for a node, out of its integrity string
+// or else its hex SHA-1 shasum. It returns false when there isn't one to go by.
+func nodeIntegrity(n *DependencyNode) (integrity, bool) {
+	found := make(map[string][]byte, 2)
+	for _, field := range strings.Fields(n.Integrity) {
+		i := strings.IndexRune(field, '-')
+		if i == -1 {
+			continue
+		}
+		//options may follow the digest, after a '?'
+		digest := field[i+1:]
+		if j := strings.IndexRune(digest, '?'); j != -1 {
+			digest = digest[:j]
+		}
+		data, err := base64.StdEncoding.DecodeString(digest)
+		if err == nil {
+			found[field[:i]] = data
+		}
+	}
+	if data, err := hex.DecodeString(n.Shasum); err == nil && n.Shasum != "" && found["sha1"] == nil {
+		found["sha1"] = data
+	}
+	for _, h := range integrityHashes {
+		if found[h.algo] != nil {
+			return integrity{h.algo, found[h.algo]}, true
+		}
+	}
+	return integrity{}, false
+}
+
+func (i integrity) String() string {
+	return i.algo + "-" + base64.StdEncoding.EncodeToString(i.digest)
+}
+
+// Hex is the digest in hex, used for paths
+func (i integrity) Hex() string {
+	return hex.EncodeToString(i.digest)
+}
+
+func (i integrity) newHash() hash.Hash {
+	for _, h := range integrityHashes {
+		if h.algo == i.algo {
+			return h.new()
+		}
+	}
+	return nil
+}
+
+// check reads r to the end, failing if it doesn't match the hash
+func (i integrity) check(r io.Reader) error {
+	h := i.newHash()
+	if h == nil {
+		return errors.New("Unsupported integrity algorithm: " + i.algo)
+	}
+	_, err := io.Copy(h, r)
+	if err != nil {
+		return err
+	}
+	if hex.EncodeToString(h.Sum(nil)) != i.Hex() {
+		return errors.New("Integrity mismatch, expected " + i.String())
+	}
+	return nil
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// node_modules layouts an Installer can produce
+const (
+	//packages are nested and hoisted exactly like the DependencyTree, the way npm does it
+	LayoutHoisted = "hoisted"
+
+	//every package is put once under node_modules/.pnpm/<name>@<version>/node_modules,
+	//seeing only the dependencies it declares through symlinks, like pnpm does it
+	LayoutIsolated = "isolated"
+)
+
+// isolatedDir is where the isolated layout keeps the packages themselves
+const isolatedDir = ".pnpm"
+
+// checkLayout makes sure a layout is one the Installer knows, empty meaning hoisted
+func checkLayout(layout string) error {
+	switch layout {
+	case "", LayoutHoisted, LayoutIsolated:
+		return nil
+	}
+	return errors.New("Unknown node_modules layout, expected hoisted or isolated: " + layout)
+}
+
+// An isolatedPackage is a single copy of a package in the isolated layout,
+// shared by every node of the tree with the same version and dependencies
+type isolatedPackage struct {
+	Key  string
+	Node *DependencyNode
+
+	//dependency name to the key of the package it's linked to
+	Deps map[string]string
+}
+
+// Dir is where the package lives, relative to node_modules
+func (p *isolatedPackage) Dir() string {
+	return filepath.Join(isolatedDir, p.Key, "node_modules", filepath.FromSlash(p.Node.Name))
+}
+
+// isolatedLayout works out the packages of the isolated layout from the nodes
+// being installed, along with what the root's node_modules links to
+func (in *Installer) isolatedLayout(t *DependencyTree) (map[string]*isolatedPackage, map[string]string, error) {
+	nodes, err := in.nodes(t)
+	if err != nil {
+		return nil, nil, err
+	}
+	included := make(map[*DependencyNode]bool, len(nodes))
+	for _, n := range nodes {
+		included[n] = true
+	}
+
+	//the same version can resolve its dependencies differently in different
+	//places of the tree, so those get their own copy with a suffix
+	keys := make(map[*DependencyNode]string, len(nodes))
+	signatures := make(map[string]string, len(nodes))
+	for _, n := range nodes {
+		base := strings.Replace(n.Name, "/", "+", -1) + "@" + n.Version
+		sig := make([]string, 0, 10)
+		for _, e := range t.edges(n) {
+			if included[e.To] {
+				sig = append(sig, e.To.Name+"@"+e.To.Version)
+			}
+		}
+		sort.Strings(sig)
+		s := strings.Join(sig, ",")
+		key := base
+		for {
+			prev, ok := signatures[key]
+			if !ok || prev == s {
+				break
+			}
+			sum := sha1.Sum([]byte(key + "\n" + s))
+			key = base + "_" + hex.EncodeToString(sum[:])[:8]
+		}
+		signatures[key] = s
+		keys[n] = key
+	}
+
+	pkgs := make(map[string]*isolatedPackage, len(signatures))
+	for _, n := range nodes {
+		if pkgs[keys[n]] != nil {
+			continue
+		}
+		p := &isolatedPackage{Key: keys[n], Node: n, Deps: make(map[string]string, 10)}
+		for _, e := range t.edges(n) {
+			if included[e.To] {
+				p.Deps[e.To.Name] = keys[e.To]
+			}
+		}
+		pkgs[p.Key] = p
+	}
+	root := make(map[string]string, len(t.Nodes))
+	for _, e := range t.edges(nil) {
+		if included[e.To] {
+			root[e.To.Name] = keys[e.To]
+		}
+	}
+	return pkgs, root, nil
+}
+
+// installIsolated brings node_modules to the isolated layout of the tree. Package
+// folders are named after their version and dependencies, so ones that are already
+// there, and that the state file says were installed in full, are kept. The rest are
+// extracted into staging and renamed into place through the journal, like updateHoisted
+// does. Links, what they replace and the state file go through the journal too.
+func (in *Installer) installIsolated(j *journal, t *DependencyTree) (changed int, removed int, fresh []*scriptPackage, err error) {
+	modules := j.modules
+	pkgs, root, err := in.isolatedLayout(t)
+	if err != nil {
+		return 0, 0, nil, err
+	}
+	state, err := readState(modules)
+	if err != nil {
+		log.Warnln("Ignoring unreadable install state:", err.Error())
+		state = &installState{}
+	}
+	if state != nil && state.Layout != LayoutIsolated {
+		state = &installState{}
+	}
+
+	infos, err := ioutil.ReadDir(filepath.Join(modules, isolatedDir))
+	if err != nil && !os.IsNotExist(err) {
+		return 0, 0, nil, err
+	}
+	existing := make(map[string]bool, len(infos))
+	for i, info := range infos {
+		key := info.Name()
+		if p := pkgs[key]; p != nil && in.trusts(state, isolatedDir+"/"+key, p.Node) {
+			pkg, err := ReadPackage(filepath.Join(modules, p.Dir()))
+			if err == nil && pkg.Name == p.Node.Name && pkg.Version == p.Node.Version {
+				existing[key] = true
+				continue
+			}
+		}
+		log.Debugln("Moving", key, "out of the way")
+		err = j.rename("stash", isolatedDir+"/"+key, "old-"+strconv.Itoa(i))
+		if err != nil {
+			return 0, 0, nil, err
+		}
+		if pkgs[key] == nil {
+			removed++
+		}
+	}
+
+	nodes := make([]*DependencyNode, 0, len(pkgs))
+	staged := make(map[*DependencyNode]string, len(pkgs))
+	byNode := make(map[*DependencyNode]string, len(pkgs))
+	for i, key := range sortedIsolatedKeys(pkgs) {
+		p := pkgs[key]
+		if existing[key] {
+			continue
+		}
+		nodes = append(nodes, p.Node)
+		staged[p.Node] = "new-" + strconv.Itoa(i)
+		byNode[p.Node] = key
+	}
+	dir := func(n *DependencyNode) string {
+		return filepath.Join(j.staged(staged[n]), "node_modules", filepath.FromSlash(n.Name))
+	}
+	err = in.extract(nodes, dir)
+	if err != nil {
+		return 0, 0, nil, err
+	}
+
+	next := &installState{Layout: LayoutIsolated, Packages: make(map[string]installedState, len(pkgs))}
+	for key := range existing {
+		next.Packages[isolatedDir+"/"+key] = state.kept(isolatedDir+"/"+key, pkgs[key].Node)
+	}
+	for _, n := range nodes {
+		//optional packages that failed to extract
+		if _, err := os.Stat(dir(n)); err != nil {
+			continue
+		}
+		err = j.rename("place", isolatedDir+"/"+byNode[n], staged[n])
+		if err != nil {
+			return 0, 0, nil, err
+		}
+		next.Packages[isolatedDir+"/"+byNode[n]] = installedState{Version: n.Version, Shasum: n.Shasum, Pending: true}
+		changed++
+		p := &scriptPackage{Node: n, Path: isolatedDir + "/" + byNode[n], Dir: filepath.Join(modules, pkgs[byNode[n]].Dir())}
+		for _, key := range pkgs[byNode[n]].Deps {
+			p.Deps = append(p.Deps, filepath.Join(modules, pkgs[key].Dir()))
+		}
+		fresh = append(fresh, p)
+	}
+
+	for _, key := range sortedIsolatedKeys(pkgs) {
+		p := pkgs[key]
+		for _, name := range sortedStringKeys(p.Deps) {
+			if name == p.Node.Name {
+				continue
+			}
+			err = j.link(path.Join(isolatedDir, key, "node_modules", name), filepath.Join(modules, pkgs[p.Deps[name]].Dir()))
+			if err != nil {
+				return 0, 0, nil, err
+			}
+		}
+	}
+
+	err = removeUnlisted(j, "", root)
+	if err != nil {
+		return 0, 0, nil, err
+	}
+	for _, name := range sortedStringKeys(root) {
+		err = j.link(name, filepath.Join(modules, pkgs[root[name]].Dir()))
+		if err != nil {
+			return 0, 0, nil, err
+		}
+	}
+	return changed, removed, fresh, j.writeState(next)
+}
+
+// removeUnlisted moves packages from an older install out of the top level of node_modules
+// into staging, looking inside scope folders. Hidden entries like .pnpm are left alone.
+func removeUnlisted(j *journal, scope string, root map[string]string) error {
+	infos, err := ioutil.ReadDir(filepath.Join(j.modules, scope))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, info := range infos {
+		name := path.Join(scope, info.Name())
+		switch {
+		case strings.HasPrefix(info.Name(), "."), root[name] != "":
+			continue
+		case scope == "" && strings.HasPrefix(info.Name(), "@") && info.IsDir():
+			err = removeUnlisted(j, name, root)
+		default:
+			err = j.remove(name)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func sortedIsolatedKeys(m map[string]*isolatedPackage) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
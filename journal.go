@@ -0,0 +1,277 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// files the installer keeps in node_modules, hidden so they're never taken for packages
+const (
+	//what the last install put there, to tell it apart from changes made by hand
+	stateFile = ".fpm-state.json"
+
+	//the renames of an install in progress, so an interrupted one can be undone
+	journalFile = ".fpm-journal"
+
+	//packages moved out of the way, or being extracted, during an install
+	stagingDir = ".fpm-staging"
+)
+
+type installState struct {
+	Layout   string                    `json:"layout"`
+	Packages map[string]installedState `json:"packages,omitempty"`
+}
+
+type installedState struct {
+	Version string `json:"version"`
+	Shasum  string `json:"shasum,omitempty"`
+
+	//set until the install scripts of a package that was just installed have succeeded
+	Pending bool `json:"pending,omitempty"`
+
+	//why its install scripts didn't run, see the scriptsSkipped reasons
+	Skipped string `json:"skipped,omitempty"`
+}
+
+// why the install scripts of a package were skipped, recorded so they
+// get another chance only once the reason no longer holds
+const (
+	//-ignore-scripts was set
+	scriptsIgnored = "ignored"
+
+	//the script policy didn't allow them
+	scriptsBlocked = "blocked"
+
+	//its package.json claims to be another package, which never changes
+	scriptsMismatched = "mismatched"
+
+	//it's optional and they failed, which doesn't fail the install
+	scriptsFailed = "failed"
+)
+
+// readState reads the state file of node_modules, returning nil if there is none
+func readState(modules string) (*installState, error) {
+	data, err := ioutil.ReadFile(filepath.Join(modules, stateFile))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	s := new(installState)
+	err = json.Unmarshal(data, s)
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func writeState(modules string, s *installState) error {
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Join(modules, stateFile), data)
+}
+
+// trusts reports if the package at path can be taken to be the node, without
+// installing it again. Without a state file, the package.json has to be enough.
+// Packages still waiting on their install scripts are never trusted, so they
+// get installed again and their scripts another chance.
+func (s *installState) trusts(path string, n *DependencyNode) bool {
+	if s == nil {
+		return true
+	}
+	e, ok := s.Packages[path]
+	return ok && !e.Pending && e.Version == n.Version && (e.Shasum == "" || n.Shasum == "" || e.Shasum == n.Shasum)
+}
+
+// kept returns what to record for a package that's kept as it is
+func (s *installState) kept(path string, n *DependencyNode) installedState {
+	if s != nil {
+		if e, ok := s.Packages[path]; ok {
+			return e
+		}
+	}
+	return installedState{Version: n.Version, Shasum: n.Shasum}
+}
+
+// a journalEntry is a single rename: "stash" moves the package at Path into
+// the staging folder as Staged, "place" moves it back out to Path
+type journalEntry struct {
+	Op     string `json:"op"`
+	Path   string `json:"path"`
+	Staged string `json:"staged"`
+}
+
+type journal struct {
+	modules string
+	fd      *os.File
+
+	//numbers what's staged without a name of its own
+	seq int
+}
+
+func openJournal(modules string) (*journal, error) {
+	err := os.MkdirAll(filepath.Join(modules, stagingDir), 0755)
+	if err != nil {
+		return nil, err
+	}
+	fd, err := os.OpenFile(filepath.Join(modules, journalFile), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &journal{modules: modules, fd: fd}, nil
+}
+
+// staged is where a staged package is kept
+func (j *journal) staged(name string) string {
+	return filepath.Join(j.modules, stagingDir, name)
+}
+
+// rename records a rename before making it, so it's never done without a way back
+func (j *journal) rename(op, path, staged string) error {
+	data, err := json.Marshal(journalEntry{op, path, staged})
+	if err != nil {
+		return err
+	}
+	_, err = j.fd.Write(append(data, '\n'))
+	if err != nil {
+		return err
+	}
+	err = j.fd.Sync()
+	if err != nil {
+		return err
+	}
+	return renameEntry(j.modules, journalEntry{op, path, staged}, false)
+}
+
+// next names something to stage
+func (j *journal) next(prefix string) string {
+	j.seq++
+	return prefix + "-" + strconv.Itoa(j.seq)
+}
+
+// remove moves whatever is at path into staging, to be dropped along with it
+func (j *journal) remove(path string) error {
+	return j.rename("stash", path, j.next("removed"))
+}
+
+// link points a relative symlink at target from path, replacing whatever was there.
+// The link is made in staging and renamed into place, so a rollback can undo both.
+func (j *journal) link(path, target string) error {
+	link := filepath.Join(j.modules, filepath.FromSlash(path))
+	rel, err := filepath.Rel(filepath.Dir(link), target)
+	if err != nil {
+		return err
+	}
+	if cur, err := os.Readlink(link); err == nil && cur == rel {
+		return nil
+	}
+	staged := j.next("link")
+	err = os.Symlink(rel, j.staged(staged))
+	if err != nil {
+		return err
+	}
+	if _, err := os.Lstat(link); err == nil {
+		err = j.remove(path)
+		if err != nil {
+			return err
+		}
+	}
+	return j.rename("place", path, staged)
+}
+
+// writeState replaces the state file through staging, so a rollback brings back the old one
+func (j *journal) writeState(s *installState) error {
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	staged := j.next("state")
+	err = writeFileAtomic(j.staged(staged), data)
+	if err != nil {
+		return err
+	}
+	if _, err := os.Lstat(filepath.Join(j.modules, stateFile)); err == nil {
+		err = j.remove(stateFile)
+		if err != nil {
+			return err
+		}
+	}
+	return j.rename("place", stateFile, staged)
+}
+
+// close finishes the install, dropping the journal and whatever is left in staging
+func (j *journal) close() error {
+	err := j.fd.Close()
+	if err != nil {
+		return err
+	}
+	err = os.Remove(j.fd.Name())
+	if err != nil {
+		return err
+	}
+	return os.RemoveAll(filepath.Join(j.modules, stagingDir))
+}
+
+// renameEntry makes the rename of an entry, or undoes it. Renames that
+// can't have happened, because their source is missing, are skipped.
+func renameEntry(modules string, e journalEntry, undo bool) error {
+	path := filepath.Join(modules, filepath.FromSlash(e.Path))
+	staged := filepath.Join(modules, stagingDir, e.Staged)
+	from, to := path, staged
+	if (e.Op == "place") != undo {
+		from, to = staged, path
+	}
+	if _, err := os.Lstat(from); os.IsNotExist(err) {
+		return nil
+	}
+	err := os.MkdirAll(filepath.Dir(to), 0755)
+	if err != nil {
+		return err
+	}
+	return os.Rename(from, to)
+}
+
+// rollback undoes the renames of an interrupted install, newest first, leaving
+// node_modules the way it was before. It reports if there was anything to undo.
+func rollback(modules string) (bool, error) {
+	fd, err := os.Open(filepath.Join(modules, journalFile))
+	if os.IsNotExist(err) {
+		return false, os.RemoveAll(filepath.Join(modules, stagingDir))
+	}
+	if err != nil {
+		return false, err
+	}
+	entries := make([]journalEntry, 0, 100)
+	s := bufio.NewScanner(fd)
+	for s.Scan() {
+		var e journalEntry
+		//the last line may have been cut short, in which case its rename never happened
+		if json.Unmarshal(s.Bytes(), &e) != nil {
+			break
+		}
+		entries = append(entries, e)
+	}
+	fd.Close()
+	if s.Err() != nil {
+		return false, s.Err()
+	}
+
+	for i := len(entries) - 1; i >= 0; i-- {
+		err = renameEntry(modules, entries[i], true)
+		if err != nil {
+			return false, err
+		}
+	}
+	err = os.Remove(filepath.Join(modules, journalFile))
+	if err != nil {
+		return false, err
+	}
+	return true, os.RemoveAll(filepath.Join(modules, stagingDir))
+}
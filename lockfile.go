@@ -0,0 +1,173 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+)
+
+// LockfileName is the file, next to package.json, that records a resolved tree
+const LockfileName = "fpm-lock.json"
+
+// A Lockfile records a resolved DependencyTree so the exact same
+// tree can be installed again without consulting the registry
+type Lockfile struct {
+	Name             string                `json:"name"`
+	Version          string                `json:"version"`
+	LockfileVersion  int                   `json:"lockfileVersion"`
+	Requires         map[string]string     `json:"requires,omitempty"`
+	DevRequires      map[string]string     `json:"devRequires,omitempty"`
+	OptionalRequires map[string]string     `json:"optionalRequires,omitempty"`
+	Dependencies     map[string]*lockEntry `json:"dependencies"`
+}
+
+type lockEntry struct {
+	Version          string                `json:"version"`
+	Resolved         string                `json:"resolved"`
+	Shasum           string                `json:"shasum,omitempty"`
+	Integrity        string                `json:"integrity,omitempty"`
+	Dev              bool                  `json:"dev,omitempty"`
+	Optional         bool                  `json:"optional,omitempty"`
+	Peer             bool                  `json:"peer,omitempty"`
+	Overridden       bool                  `json:"overridden,omitempty"`
+	HasInstallScript bool                  `json:"hasInstallScript,omitempty"`
+	Requires         map[string]string     `json:"requires,omitempty"`
+	OptionalRequires map[string]string     `json:"optionalRequires,omitempty"`
+	PeerRequires     map[string]string     `json:"peerRequires,omitempty"`
+	Dependencies     map[string]*lockEntry `json:"dependencies,omitempty"`
+	PlatformSupport
+}
+
+// NewLockfile creates a lockfile for the tree resolved from the root package
+func NewLockfile(root *Package, t *DependencyTree) *Lockfile {
+	l := new(Lockfile)
+	l.Name = root.Name
+	l.Version = root.Version
+	l.LockfileVersion = 1
+	l.Requires = t.Requires
+	l.DevRequires = t.DevRequires
+	l.OptionalRequires = t.OptionalRequires
+	l.Dependencies = lockEntries(t.Nodes)
+	return l
+}
+
+func lockEntries(nodes map[string]*DependencyNode) map[string]*lockEntry {
+	if len(nodes) == 0 {
+		return nil
+	}
+	m := make(map[string]*lockEntry, len(nodes))
+	for k, n := range nodes {
+		m[k] = &lockEntry{
+			Version:          n.Version,
+			Resolved:         n.Tarball,
+			Shasum:           n.Shasum,
+			Integrity:        n.Integrity,
+			Dev:              n.Dev,
+			Optional:         n.Optional,
+			Peer:             n.Peer,
+			Overridden:       n.Overridden,
+			HasInstallScript: n.HasInstallScript,
+			PlatformSupport:  n.PlatformSupport,
+			Requires:         n.Requires,
+			OptionalRequires: n.OptionalRequires,
+			PeerRequires:     n.PeerRequires,
+			Dependencies:     lockEntries(n.Nodes),
+		}
+	}
+	return m
+}
+
+// ReadLockfile reads a lockfile from disk
+func ReadLockfile(path string) (*Lockfile, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	l := new(Lockfile)
+	err = json.Unmarshal(data, l)
+	if err != nil {
+		return nil, err
+	}
+	if l.LockfileVersion != 1 {
+		return nil, errors.New("Unsupported lockfile version in: " + path)
+	}
+	return l, nil
+}
+
+// Write saves the lockfile to disk, replacing any existing one
+func (l *Lockfile) Write(path string) error {
+	data, err := json.MarshalIndent(l, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, append(data, '\n'))
+}
+
+// Tree rebuilds the DependencyTree recorded in the lockfile
+func (l *Lockfile) Tree() *DependencyTree {
+	t := new(DependencyTree)
+	t.Requires = l.Requires
+	t.DevRequires = l.DevRequires
+	t.OptionalRequires = l.OptionalRequires
+	t.Nodes = treeNodes(nil, l.Dependencies)
+	return t
+}
+
+func treeNodes(parent *DependencyNode, entries map[string]*lockEntry) map[string]*DependencyNode {
+	m := make(map[string]*DependencyNode, len(entries))
+	for k, e := range entries {
+		n := &DependencyNode{
+			Name:             k,
+			Version:          e.Version,
+			Tarball:          e.Resolved,
+			Shasum:           e.Shasum,
+			Integrity:        e.Integrity,
+			Dev:              e.Dev,
+			Optional:         e.Optional,
+			Peer:             e.Peer,
+			Overridden:       e.Overridden,
+			HasInstallScript: e.HasInstallScript,
+			PlatformSupport:  e.PlatformSupport,
+			Requires:         e.Requires,
+			OptionalRequires: e.OptionalRequires,
+			PeerRequires:     e.PeerRequires,
+			Parent:           parent,
+		}
+		n.Nodes = treeNodes(n, e.Dependencies)
+		m[k] = n
+	}
+	return m
+}
+
+// Satisfies checks that every dependency of the root package is locked
+// at a version matching its range, i.e. that the lockfile is not stale.
+// Optional dependencies may be missing, since they are allowed to fail.
+func (l *Lockfile) Satisfies(root *Package) error {
+	check := func(deps DependencyMap, optional bool) error {
+		for name, req := range deps {
+			e := l.Dependencies[name]
+			if e == nil {
+				if optional || root.OptionalDependencies[name] != nil {
+					continue
+				}
+				return errors.New("Lockfile is missing dependency: " + name)
+			}
+			sv, err := parseDown(e.Version)
+			if err != nil {
+				return err
+			}
+			if !req.SatisfiedBy(sv) {
+				return errors.New("Lockfile has " + name + "@" + e.Version + " which does not satisfy: " + req.Range())
+			}
+		}
+		return nil
+	}
+	err := check(root.Dependencies, false)
+	if err == nil {
+		err = check(root.DevDependencies, false)
+	}
+	if err == nil {
+		err = check(root.OptionalDependencies, true)
+	}
+	return err
+}
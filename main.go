@@ -1,29 +1,303 @@
 package main
 
 import (
-	log "github.com/Sirupsen/logrus"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
 	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
 )
 
-func main() {
-	log.SetLevel(log.DebugLevel)
-	r := NewRegistry("http://registry.npmjs.org")
-	m := make(DependencyMap, 2)
-	var err error
-	req, err := NewSemverRequirements("^4")
+const defaultRegistry = "https://registry.npmjs.org"
+
+type command struct {
+	usage string
+	help  string
+	run   func(args []string) error
+}
+
+var commands map[string]command
+
+func init() {
+	commands = map[string]command{
+		"install":  {"install", "resolve package.json dependencies, write the lockfile and install them", cmdInstall},
+		"ci":       {"ci", "install exactly what the lockfile records", cmdCI},
+		"add":      {"add <pkg>[@range]...", "add dependencies to package.json and install them", cmdAdd},
+		"remove":   {"remove <pkg>...", "remove dependencies from package.json and node_modules", cmdRemove},
+		"ls":       {"ls", "print the installed dependency tree", cmdLs},
+		"why":      {"why <pkg>[@range]", "show the dependency paths that lead to a package", cmdWhy},
+		"outdated": {"outdated", "compare installed, wanted and latest versions of dependencies", cmdOutdated},
+		"upgrade":  {"upgrade", "bump dependency ranges in package.json to newer versions", cmdUpgrade},
+		"view":     {"view <pkg>[@range]", "show registry information about a package", cmdView},
+		"cache":    {"cache ls|clean|verify", "manage the tarball cache", cmdCache},
+		"pack":     {"pack", "create a tarball of the current package", cmdPack},
+		"scripts":  {"scripts", "list the packages with install scripts and whether they may run", cmdScripts},
+		"run":      {"run [<script>] [-- args]", "run a script from package.json, or list them", cmdRun},
+	}
+}
+
+// options are the flags shared by every command
+type options struct {
+	registry string
+	cacheDir string
+	logLevel string
+	json     bool
+	dir      string
+	before   dateFlag
+	minAge   int
+	exempt   listFlag
+	noStore  bool
+	layout   string
+
+	ignoreScripts bool
+	scriptPolicy  string
+	strictScripts bool
+}
+
+func defaultCacheDir() string {
+	if dir := os.Getenv("FPM_CACHE"); dir != "" {
+		return dir
+	}
+	home, err := os.UserHomeDir()
 	if err != nil {
-		log.Fatalln(err)
+		return ".fpm"
+	}
+	return filepath.Join(home, ".fpm")
+}
+
+func newFlagSet(name string) (*flag.FlagSet, *options) {
+	o := new(options)
+	o.exempt = make(listFlag)
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.StringVar(&o.registry, "registry", defaultRegistry, "registry `url` to fetch packages from")
+	fs.StringVar(&o.cacheDir, "cache", defaultCacheDir(), "cache `dir`ectory")
+	fs.BoolVar(&o.noStore, "no-store", false, "extract packages into node_modules instead of linking them from the store")
+	fs.StringVar(&o.layout, "layout", "", "node_modules `layout`, hoisted or isolated (default: fpm.layout in package.json, or hoisted)")
+	fs.BoolVar(&o.ignoreScripts, "ignore-scripts", false, "don't run lifecycle scripts")
+	fs.BoolVar(&o.strictScripts, "strict-scripts", false, "run no install scripts unless a script policy allows them (default: fpm.strictScripts in package.json)")
+	fs.StringVar(&o.scriptPolicy, "script-policy", "", "`file` listing the packages allowed to run install scripts (default: "+ScriptPolicyName+" in the project, if there is one)")
+	fs.StringVar(&o.logLevel, "loglevel", "warn", "log `level`: debug, info, warn or error")
+	fs.BoolVar(&o.json, "json", false, "print output as JSON")
+	fs.StringVar(&o.dir, "C", ".", "project `dir`ectory")
+	fs.IntVar(&o.minAge, "min-release-age", 0, "skip versions published less than `days` ago")
+	fs.Var(o.exempt, "min-release-age-exempt", "comma separated `packages` that -min-release-age doesn't apply to")
+	fs.Var(&o.before, "before", "ignore versions published after this `date` (YYYY-MM-DD or RFC 3339)")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: fpm", commands[name].usage, "[flags]")
+		fs.PrintDefaults()
+	}
+	return fs, o
+}
+
+// parseArgs parses flags that may be mixed in with positional arguments,
+// returning the positional ones. Anything after "--" is left untouched.
+func parseArgs(fs *flag.FlagSet, args []string) ([]string, error) {
+	pos := make([]string, 0, len(args))
+	for {
+		err := fs.Parse(args)
+		if err != nil {
+			return nil, err
+		}
+		rest := fs.Args()
+		if len(rest) == 0 {
+			return pos, nil
+		}
+		if len(args) > len(rest) && args[len(args)-len(rest)-1] == "--" {
+			return append(pos, rest...), nil
+		}
+		pos = append(pos, rest[0])
+		args = rest[1:]
+	}
+}
+
+// omitFlag is a comma separated list of node kinds to leave out of an install
+type omitFlag map[string]bool
+
+func (f omitFlag) String() string {
+	return strings.Join(sortedBoolKeys(f), ",")
+}
+func (f omitFlag) Set(value string) error {
+	for _, v := range strings.Split(value, ",") {
+		switch v {
+		case "dev", "optional", "peer":
+			f[v] = true
+		default:
+			return errors.New("Unknown omit type: " + v)
+		}
+	}
+	return nil
+}
+
+// listFlag is a comma separated set of names, which may be given more than once
+type listFlag map[string]bool
+
+func (f listFlag) String() string {
+	return strings.Join(sortedBoolKeys(f), ",")
+}
+func (f listFlag) Set(value string) error {
+	for _, v := range strings.Split(value, ",") {
+		if v != "" {
+			f[v] = true
+		}
+	}
+	return nil
+}
+
+// dateFlag is a date or timestamp, a plain date meaning the end of that day in UTC
+type dateFlag struct {
+	time.Time
+}
+
+func (f *dateFlag) String() string {
+	if f.IsZero() {
+		return ""
 	}
-	m["express"] = req
-	req, err = NewSemverRequirements("")
+	return f.Format(time.RFC3339)
+}
+func (f *dateFlag) Set(value string) error {
+	t, err := time.Parse(time.RFC3339, value)
+	if err == nil {
+		f.Time = t
+		return nil
+	}
+	t, err = time.Parse("2006-01-02", value)
 	if err != nil {
-		log.Fatalln(err)
+		return errors.New("Invalid date, expected YYYY-MM-DD or RFC 3339: " + value)
 	}
-	m["grunt"] = req
+	f.Time = t.Add(24*time.Hour - time.Nanosecond)
+	return nil
+}
+
+func sortedBoolKeys(m map[string]bool) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (o *options) setup() error {
+	lvl, err := log.ParseLevel(o.logLevel)
+	if err != nil {
+		return err
+	}
+	log.SetLevel(lvl)
+	return nil
+}
+
+func (o *options) registryClient() *Registry {
+	r := NewRegistry(o.registry)
+	r.Before = o.before.Time
+	r.MinReleaseAge = time.Duration(o.minAge) * 24 * time.Hour
+	r.ReleaseAgeExempt = o.exempt
+	return r
+}
+
+func (o *options) cache() *Cache {
+	return NewCache(o.cacheDir)
+}
+
+func (o *options) store() *Store {
+	return NewStore(filepath.Join(o.cacheDir, "store"))
+}
+
+// installer returns an Installer for the project, linking from the store unless -no-store
+// is given. The layout comes from -layout, or the project's package.json.
+func (o *options) installer(pkg *Package) (*Installer, error) {
+	in := NewInstaller(o.dir, o.cache())
+	if !o.noStore {
+		in.Store = o.store()
+	}
+	in.IgnoreScripts = o.ignoreScripts
+	policy, err := o.policy(pkg)
+	if err != nil {
+		return nil, err
+	}
+	in.ScriptPolicy = policy
+	in.Layout = pkg.Fpm.Layout
+	if o.layout != "" {
+		in.Layout = o.layout
+	}
+	return in, checkLayout(in.Layout)
+}
 
-	tree, err := CalculateTree(r, m)
+// policy reads the script policy given with -script-policy, or else the project's
+// own if it has one. Without either, every package may run its install scripts,
+// unless -strict-scripts or fpm.strictScripts in package.json say none may.
+func (o *options) policy(pkg *Package) (*ScriptPolicy, error) {
+	if o.scriptPolicy != "" {
+		return ReadScriptPolicy(o.scriptPolicy)
+	}
+	p, err := ReadScriptPolicy(filepath.Join(o.dir, ScriptPolicyName))
+	if !os.IsNotExist(err) {
+		return p, err
+	}
+	if o.strictScripts || pkg.Fpm.StrictScripts {
+		log.Warnf("No %s found, so no install scripts may run", ScriptPolicyName)
+		return new(ScriptPolicy), nil
+	}
+	return nil, nil
+}
+
+func (o *options) lockfilePath() string {
+	return filepath.Join(o.dir, LockfileName)
+}
+
+func printJSON(v interface{}) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Println(string(data))
+	return err
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "Usage: fpm <command> [flags] [args]")
+	fmt.Fprintln(os.Stderr)
+	fmt.Fprintln(os.Stderr, "Commands:")
+	names := make([]string, 0, len(commands))
+	for k := range commands {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	for _, k := range names {
+		fmt.Fprintf(os.Stderr, "  %-24s %s\n", commands[k].usage, commands[k].help)
+	}
+	fmt.Fprintln(os.Stderr)
+	fmt.Fprintln(os.Stderr, "Run 'fpm <command> -h' for the flags of a command.")
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(2)
+	}
+	cmd, ok := commands[os.Args[1]]
+	if !ok {
+		if os.Args[1] != "help" && os.Args[1] != "-h" && os.Args[1] != "--help" {
+			fmt.Fprintln(os.Stderr, "Unknown command:", os.Args[1])
+		}
+		usage()
+		os.Exit(2)
+	}
+	err := cmd.run(os.Args[2:])
+	if err == flag.ErrHelp {
+		os.Exit(2)
+	}
+	//a failing "fpm run" exits with the status of the script, like npm
+	if se, ok := err.(*ScriptError); ok {
+		log.Errorln(err)
+		os.Exit(se.ExitCode())
+	}
 	if err != nil {
 		log.Fatalln(err)
 	}
-	tree.Print(os.Stdout)
 }
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+
+	"github.com/mastercactapus/go-fpm/omap"
+)
+
+// ReadPackage reads the package.json found in dir
+func ReadPackage(dir string) (*Package, error) {
+	data, err := ioutil.ReadFile(filepath.Join(dir, "package.json"))
+	if err != nil {
+		return nil, err
+	}
+	p := new(Package)
+	err = json.Unmarshal(data, p)
+	if err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// A PackageFile is a package.json being edited. Fields keep their order and
+// the file keeps its indentation when written back.
+type PackageFile struct {
+	Path   string
+	Fields *omap.OrderedMap
+
+	indent  string
+	newline bool
+}
+
+// ReadPackageFile reads the package.json found in dir for editing
+func ReadPackageFile(dir string) (*PackageFile, error) {
+	path := filepath.Join(dir, "package.json")
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	f := &PackageFile{Path: path, Fields: omap.NewOrderedMap(), indent: "  "}
+	err = json.Unmarshal(data, f.Fields)
+	if err != nil {
+		return nil, err
+	}
+
+	//indentation is whatever starts the second line
+	if i := bytes.IndexByte(data, '\n'); i >= 0 {
+		line := data[i+1:]
+		n := 0
+		for n < len(line) && (line[n] == ' ' || line[n] == '\t') {
+			n++
+		}
+		if n > 0 {
+			f.indent = string(line[:n])
+		}
+	}
+	f.newline = bytes.HasSuffix(data, []byte("\n"))
+	return f, nil
+}
+
+// marshalRaw encodes a value without escaping HTML characters like '&',
+// which show up in scripts and shouldn't change when a file is rewritten
+func marshalRaw(v interface{}) (json.RawMessage, error) {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	err := enc.Encode(v)
+	if err != nil {
+		return nil, err
+	}
+	return bytes.TrimRight(buf.Bytes(), "\n"), nil
+}
+
+// Section returns an object field like "dependencies", empty if missing
+func (f *PackageFile) Section(name string) (*omap.OrderedMap, error) {
+	m := omap.NewOrderedMap()
+	raw := f.Fields.Get(name)
+	if raw == nil {
+		return m, nil
+	}
+	err := json.Unmarshal(raw, m)
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// SetSection replaces an object field, keeping its position
+func (f *PackageFile) SetSection(name string, m *omap.OrderedMap) error {
+	data, err := marshalRaw(m)
+	if err != nil {
+		return err
+	}
+	f.Fields.Set(name, data)
+	return nil
+}
+
+// Package decodes the file as it currently stands
+func (f *PackageFile) Package() (*Package, error) {
+	data, err := marshalRaw(f.Fields)
+	if err != nil {
+		return nil, err
+	}
+	p := new(Package)
+	err = json.Unmarshal(data, p)
+	if err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// Write saves the file back to disk
+func (f *PackageFile) Write() error {
+	data, err := marshalRaw(f.Fields)
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	err = json.Indent(&buf, data, "", f.indent)
+	if err != nil {
+		return err
+	}
+	if f.newline {
+		buf.WriteByte('\n')
+	}
+	return writeFileAtomic(f.Path, buf.Bytes())
+}
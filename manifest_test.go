@@ -0,0 +1,59 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const testPackageJSON = `{
+    "name": "app",
+    "version": "1.0.0",
+    "scripts": {
+        "test": "lint && test"
+    },
+    "dependencies": {
+        "b": "~1.0.0",
+        "a": "^1.0.0",
+        "c": "1.x",
+        "d": ">=1.0.0 <3"
+    },
+    "devDependencies": {
+        "e": "1.0.0"
+    }
+}
+`
+
+func _testPackageFile(t *testing.T, data string) (*PackageFile, string) {
+	dir, err := ioutil.TempDir("", "fpm-manifest")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %s\n", err.Error())
+	}
+	err = ioutil.WriteFile(filepath.Join(dir, "package.json"), []byte(data), 0644)
+	if err != nil {
+		t.Fatalf("Failed to write package.json: %s\n", err.Error())
+	}
+	f, err := ReadPackageFile(dir)
+	if err != nil {
+		t.Fatalf("Failed to read package.json: %s\n", err.Error())
+	}
+	return f, dir
+}
+
+func TestPackageFile_Write(t *testing.T) {
+	f, dir := _testPackageFile(t, testPackageJSON)
+	defer os.RemoveAll(dir)
+
+	err := f.Write()
+	if err != nil {
+		t.Fatalf("Failed to write package.json: %s\n", err.Error())
+	}
+	data, err := ioutil.ReadFile(f.Path)
+	if err != nil {
+		t.Fatalf("Failed to read package.json: %s\n", err.Error())
+	}
+	if string(data) != testPackageJSON {
+		t.Errorf("Expected package.json to be unchanged but got:\n%s", string(data))
+	}
+}
@@ -79,6 +79,28 @@ func (o *OrderedMap) Get(k string) json.RawMessage {
 	return o.m[k]
 }
 
+// Delete removes a key from the map
+func (o *OrderedMap) Delete(k string) {
+	if !o.has[k] {
+		return
+	}
+	delete(o.has, k)
+	delete(o.m, k)
+	for i, key := range o.k {
+		if key == k {
+			o.k = append(o.k[:i], o.k[i+1:]...)
+			break
+		}
+	}
+}
+
+// Keys returns the keys of the map in order
+func (o *OrderedMap) Keys() []string {
+	keys := make([]string, len(o.k))
+	copy(keys, o.k)
+	return keys
+}
+
 func nextPair(d *decodeReader) (pair *keyVal, err error) {
 
 	//next token should be '{', ',', or '}'
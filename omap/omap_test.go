@@ -76,6 +76,43 @@ func ExampleOrderedMap_Get() {
 	//Output: 1
 }
 
+func ExampleOrderedMap_Keys() {
+	jsonData := `{
+		"z": 1,
+		"a": 2
+	}`
+
+	m := NewOrderedMap()
+	err := json.Unmarshal([]byte(jsonData), &m)
+	if err != nil {
+		fmt.Println("error:", err)
+	}
+
+	fmt.Println(m.Keys())
+	//Output: [z a]
+}
+
+func ExampleOrderedMap_Delete() {
+	jsonData := `{
+		"z": 1,
+		"a": 2
+	}`
+
+	m := NewOrderedMap()
+	err := json.Unmarshal([]byte(jsonData), &m)
+	if err != nil {
+		fmt.Println("error:", err)
+	}
+	m.Delete("z")
+	m.Set("z", m.Get("a"))
+	data, err := json.Marshal(&m)
+	if err != nil {
+		fmt.Println("error:", err)
+	}
+	fmt.Println(string(data))
+	//Output: {"a":2,"z":2}
+}
+
 func TestUnmarshalMarshalJSON(t *testing.T) {
 	var m = NewOrderedMap()
 	err := json.Unmarshal([]byte(SimpleJSON), &m)
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"sort"
+	"strings"
+)
+
+// An overrideRule forces the range used for a package, like npm's `overrides` and yarn's
+// `resolutions`. Its children only apply within the dependencies of that package.
+type overrideRule struct {
+	name string
+	//only applies to ranges that could match it, nil for any
+	selector *SemverRequirements
+	//replacement range, empty to leave it as is
+	value    *SemverRequirements
+	children []*overrideRule
+}
+
+// overrideContext is the stack of rules in effect for a part of the tree
+type overrideContext struct {
+	rules  []*overrideRule
+	parent *overrideContext
+}
+
+// parseOverrides reads the `overrides` and `resolutions` fields of the root package
+func parseOverrides(root *Package) ([]*overrideRule, error) {
+	rules := make([]*overrideRule, 0, 10)
+	if len(root.Overrides) > 0 {
+		var raw map[string]json.RawMessage
+		err := json.Unmarshal(root.Overrides, &raw)
+		if err != nil {
+			return nil, errors.New("Invalid overrides: " + err.Error())
+		}
+		rules, err = parseOverrideRules(root, raw)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var resolutions map[string]string
+	if len(root.Resolutions) > 0 {
+		err := json.Unmarshal(root.Resolutions, &resolutions)
+		if err != nil {
+			return nil, errors.New("Invalid resolutions: " + err.Error())
+		}
+	}
+	for _, key := range sortedStringKeys(resolutions) {
+		path := splitResolutionPath(key)
+		value, err := overrideValue(root, resolutions[key])
+		if err != nil {
+			return nil, err
+		}
+		level := &rules
+		for i, spec := range path {
+			name, rng := splitSpec(spec)
+			var rule *overrideRule
+			for _, r := range *level {
+				if r.name == name && (r.selector == nil) == (rng == "") && (rng == "" || r.selector.Range() == rng) {
+					rule = r
+				}
+			}
+			if rule == nil {
+				rule = &overrideRule{name: name}
+				if rng != "" {
+					rule.selector, err = NewSemverRequirements(rng)
+					if err != nil {
+						return nil, errors.New("Invalid resolution '" + key + "': " + err.Error())
+					}
+				}
+				*level = append(*level, rule)
+			}
+			if i == len(path)-1 {
+				rule.value = value
+			}
+			level = &rule.children
+		}
+	}
+
+	//a direct dependency can only be overridden with the range it already has
+	for _, rule := range rules {
+		if rule.value == nil {
+			continue
+		}
+		for _, deps := range []DependencyMap{root.Dependencies, root.DevDependencies, root.OptionalDependencies} {
+			if req := deps[rule.name]; req != nil && req.Range() != rule.value.Range() {
+				return nil, errors.New("Override for " + rule.name + "@" + rule.value.Range() +
+					" conflicts with direct dependency " + rule.name + "@" + req.Range() + ", use \"$" + rule.name + "\" to refer to it")
+			}
+		}
+	}
+	return rules, nil
+}
+
+func parseOverrideRules(root *Package, raw map[string]json.RawMessage) ([]*overrideRule, error) {
+	keys := make([]string, 0, len(raw))
+	for k := range raw {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	rules := make([]*overrideRule, 0, len(raw))
+	for _, key := range keys {
+		name, rng := splitSpec(key)
+		rule := &overrideRule{name: name}
+		var err error
+		if rng != "" {
+			rule.selector, err = NewSemverRequirements(rng)
+			if err != nil {
+				return nil, errors.New("Invalid override '" + key + "': " + err.Error())
+			}
+		}
+
+		var value string
+		if json.Unmarshal(raw[key], &value) == nil {
+			rule.value, err = overrideValue(root, value)
+			if err != nil {
+				return nil, err
+			}
+			rules = append(rules, rule)
+			continue
+		}
+		var nested map[string]json.RawMessage
+		err = json.Unmarshal(raw[key], &nested)
+		if err != nil {
+			return nil, errors.New("Invalid override '" + key + "': expected a string or object")
+		}
+		//"." overrides the package itself, the rest apply to its dependencies
+		if self, ok := nested["."]; ok {
+			delete(nested, ".")
+			if json.Unmarshal(self, &value) != nil {
+				return nil, errors.New("Invalid override '" + key + "': expected a string for \".\"")
+			}
+			rule.value, err = overrideValue(root, value)
+			if err != nil {
+				return nil, err
+			}
+		}
+		rule.children, err = parseOverrideRules(root, nested)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// overrideValue parses a replacement range, following "$name" references to the root's dependencies
+func overrideValue(root *Package, value string) (*SemverRequirements, error) {
+	if strings.HasPrefix(value, "$") {
+		name := value[1:]
+		for _, deps := range []DependencyMap{root.Dependencies, root.DevDependencies, root.OptionalDependencies, root.PeerDependencies} {
+			if deps[name] != nil {
+				return deps[name], nil
+			}
+		}
+		return nil, errors.New("Override references " + value + " but the root package does not depend on " + name)
+	}
+	return NewSemverRequirements(value)
+}
+
+// splitResolutionPath splits a yarn resolution key like "a/@scope/b/**/c" into its package specs.
+// Since rules apply to a whole subtree, "**" needs no special treatment.
+func splitResolutionPath(key string) []string {
+	parts := strings.Split(key, "/")
+	path := make([]string, 0, len(parts))
+	for i := 0; i < len(parts); i++ {
+		if parts[i] == "**" || parts[i] == "" {
+			continue
+		}
+		if strings.HasPrefix(parts[i], "@") && i+1 < len(parts) {
+			path = append(path, parts[i]+"/"+parts[i+1])
+			i++
+			continue
+		}
+		path = append(path, parts[i])
+	}
+	return path
+}
+
+// overlaps reports if a version of a package could satisfy both requirements
+func overlaps(r *Registry, name string, a, b *SemverRequirements) bool {
+	versions, err := r.PackageVersions(name)
+	if err != nil {
+		return false
+	}
+	for _, v := range versions {
+		if a.SatisfiedBy(v) && b.SatisfiedBy(v) {
+			return true
+		}
+	}
+	return false
+}
+
+// lookup finds the innermost rule for a dependency on `name` with the requested range
+func (c *overrideContext) lookup(r *Registry, name string, req *SemverRequirements) *overrideRule {
+	for ; c != nil; c = c.parent {
+		for _, rule := range c.rules {
+			if rule.name != name {
+				continue
+			}
+			if rule.selector == nil || overlaps(r, name, rule.selector, req) {
+				return rule
+			}
+		}
+	}
+	return nil
+}
+
+// enter returns the context for the dependencies of a package, given the rule that matched it
+func (c *overrideContext) enter(rule *overrideRule) *overrideContext {
+	if rule == nil || len(rule.children) == 0 {
+		return c
+	}
+	return &overrideContext{rule.children, c}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// npm uses a fixed mtime so packing the same files twice gives the same tarball
+var packTime = time.Date(1985, time.October, 26, 8, 15, 0, 0, time.UTC)
+
+// files that are always included or excluded from a packed tarball, regardless of `files`
+var packAlways = []string{"package.json", "readme", "license", "licence", "changelog"}
+var packNever = map[string]bool{".git": true, "node_modules": true, ".npmrc": true, LockfileName: true}
+
+// PackResult describes a tarball created by Pack
+type PackResult struct {
+	Filename string   `json:"filename"`
+	Shasum   string   `json:"shasum"`
+	Files    []string `json:"files"`
+}
+
+// packTarballName returns the npm style tarball name, e.g. "scope-name-1.0.0.tgz"
+func packTarballName(name, version string) string {
+	name = strings.Replace(strings.TrimPrefix(name, "@"), "/", "-", 1)
+	return name + "-" + version + ".tgz"
+}
+
+// packFiles lists the files of the package in dir that belong in its tarball
+func packFiles(dir string, p *Package) ([]string, error) {
+	files := make([]string, 0, 100)
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		if rel == "." {
+			return nil
+		}
+		rel = filepath.ToSlash(rel)
+		if packNever[info.Name()] || (strings.HasSuffix(info.Name(), ".tgz") && !strings.Contains(rel, "/")) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if info.IsDir() || !info.Mode().IsRegular() {
+			return nil
+		}
+		if packIncluded(rel, p.Files) {
+			files = append(files, rel)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+func packIncluded(rel string, patterns []string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	if !strings.Contains(rel, "/") {
+		base := strings.ToLower(rel)
+		for _, a := range packAlways {
+			if base == a || strings.HasPrefix(base, a+".") {
+				return true
+			}
+		}
+	}
+	for _, pat := range patterns {
+		pat = strings.TrimSuffix(strings.TrimPrefix(pat, "./"), "/")
+		if rel == pat || strings.HasPrefix(rel, pat+"/") {
+			return true
+		}
+		if ok, _ := filepath.Match(pat, rel); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Pack creates a tarball of the package in dir, in the format the registry serves them,
+// and writes it to outDir
+func Pack(dir, outDir string) (*PackResult, error) {
+	p, err := ReadPackage(dir)
+	if err != nil {
+		return nil, err
+	}
+	if p.Name == "" || p.Version == "" {
+		return nil, errors.New("package.json must have a name and version to be packed")
+	}
+	files, err := packFiles(dir, p)
+	if err != nil {
+		return nil, err
+	}
+
+	res := &PackResult{Filename: packTarballName(p.Name, p.Version), Files: files}
+	out := filepath.Join(outDir, res.Filename)
+	fd, err := os.Create(out)
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+	h := sha1.New()
+	gz := gzip.NewWriter(io.MultiWriter(fd, h))
+	tw := tar.NewWriter(gz)
+	for _, f := range files {
+		err = packFile(tw, dir, f)
+		if err != nil {
+			return nil, err
+		}
+	}
+	err = tw.Close()
+	if err != nil {
+		return nil, err
+	}
+	err = gz.Close()
+	if err != nil {
+		return nil, err
+	}
+	res.Shasum = hex.EncodeToString(h.Sum(nil))
+	return res, fd.Close()
+}
+
+func packFile(tw *tar.Writer, dir, rel string) error {
+	fd, err := os.Open(filepath.Join(dir, filepath.FromSlash(rel)))
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+	info, err := fd.Stat()
+	if err != nil {
+		return err
+	}
+	mode := int64(0644)
+	if info.Mode()&0111 != 0 {
+		mode = 0755
+	}
+	err = tw.WriteHeader(&tar.Header{
+		Name:     "package/" + rel,
+		Mode:     mode,
+		Size:     info.Size(),
+		ModTime:  packTime,
+		Typeflag: tar.TypeReg,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(tw, fd)
+	return err
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPack(t *testing.T) {
+	dir := _testDir(t, "fpm-pack")
+	files := map[string]string{
+		"package.json":          `{"name":"@scope/pkg","version":"1.2.3","files":["lib"]}`,
+		"README.md":             "readme",
+		"lib/index.js":          "index",
+		"test/test.js":          "test",
+		"node_modules/x/y.js":   "dep",
+		"lib/node_modules/z.js": "nested dep",
+	}
+	for name, data := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		os.MkdirAll(filepath.Dir(path), 0755)
+		err := ioutil.WriteFile(path, []byte(data), 0644)
+		if err != nil {
+			t.Fatalf("Failed to write '%s': %s\n", name, err.Error())
+		}
+	}
+
+	res, err := Pack(dir, dir)
+	if err != nil {
+		t.Fatalf("Failed to pack: %s\n", err.Error())
+	}
+	if res.Filename != "scope-pkg-1.2.3.tgz" {
+		t.Errorf("Expected filename 'scope-pkg-1.2.3.tgz' but got '%s'", res.Filename)
+	}
+
+	out := filepath.Join(dir, "out")
+	err = extractTarball(filepath.Join(dir, res.Filename), out)
+	if err != nil {
+		t.Fatalf("Failed to extract packed tarball: %s\n", err.Error())
+	}
+	for _, name := range []string{"package.json", "README.md", "lib/index.js"} {
+		data, err := ioutil.ReadFile(filepath.Join(out, filepath.FromSlash(name)))
+		if err != nil {
+			t.Errorf("Expected '%s' in tarball: %s", name, err.Error())
+		} else if string(data) != files[name] {
+			t.Errorf("Expected '%s' to contain '%s' but got '%s'", name, files[name], string(data))
+		}
+	}
+	for _, name := range []string{"test/test.js", "node_modules/x/y.js", "lib/node_modules/z.js"} {
+		if _, err := os.Stat(filepath.Join(out, filepath.FromSlash(name))); err == nil {
+			t.Errorf("Expected '%s' to be left out of the tarball", name)
+		}
+	}
+}
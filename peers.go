@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// A PeerConflict is a peer dependency that could not be met because
+// an incompatible version was already in place
+type PeerConflict struct {
+	Package string
+	Name    string
+	Range   string
+	Found   string
+
+	dependent *DependencyNode
+	existing  *DependencyNode
+}
+
+// A PeerConflictError is returned when resolution ends with unmet peer dependencies
+type PeerConflictError struct {
+	Tree      *DependencyTree
+	Conflicts []PeerConflict
+}
+
+func (e *PeerConflictError) Error() string {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "Unable to resolve %d conflicting peer dependencies", len(e.Conflicts))
+	for _, c := range e.Conflicts {
+		buf.WriteString("\n\n")
+		buf.WriteString(e.Tree.ExplainPeerConflict(c))
+	}
+	buf.WriteString("\n\nRun with -solver to search for versions that agree, or with")
+	buf.WriteString("\n-legacy-peer-deps to ignore peer dependencies and install anyway.")
+	return buf.String()
+}
+
+// ExplainPeerConflict describes a conflict, with the dependency paths that led
+// to both the package wanting the peer and the version that got picked instead
+func (n *DependencyTree) ExplainPeerConflict(c PeerConflict) string {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "%s@%s was picked for:\n", c.Name, c.Found)
+	if c.existing != nil {
+		for _, e := range n.edgesTo(c.existing) {
+			buf.WriteString("  " + formatPath(append(n.PathTo(e.From), e)) + "\n")
+		}
+	}
+	fmt.Fprintf(&buf, "but %s has a peer dependency on %s@%s:\n", c.Package, c.Name, c.Range)
+	if c.dependent != nil {
+		buf.WriteString("  " + formatPath(n.PathTo(c.dependent)))
+	}
+	req, err := NewSemverRequirements(c.Range)
+	if err == nil {
+		fmt.Fprintf(&buf, "\n  which accepts %s", req.String())
+	}
+	return buf.String()
+}
+
+// edgesTo returns every resolved dependency that leads to a node, excluding peers
+func (n *DependencyTree) edgesTo(target *DependencyNode) []DependencyEdge {
+	result := make([]DependencyEdge, 0, 10)
+	collect := func(from *DependencyNode) {
+		for _, e := range n.edges(from) {
+			if e.To == target && e.Kind != depPeer {
+				result = append(result, e)
+			}
+		}
+	}
+	collect(nil)
+	n.Walk(collect)
+	return result
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"runtime"
+	"sync"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// A Pipeline downloads and unpacks packages while the tree is still being resolved,
+// so network and disk work overlap resolution instead of waiting for all of it.
+// Nodes go through a fetch stage, filling the cache, then an unpack stage adding them
+// to the store. Each stage has its own pool of workers behind a bounded queue, so a
+// stage that falls behind blocks the one feeding it, and in the end the resolver.
+//
+// Nothing here is final: the Installer still places every package, finding it
+// ready in the cache or store, and handles whatever failed here on its own.
+type Pipeline struct {
+	in *Installer
+
+	fetch   chan *DependencyNode
+	unpack  chan *DependencyNode
+	fetched sync.WaitGroup
+	done    sync.WaitGroup
+
+	mx   sync.Mutex
+	seen map[string]bool
+}
+
+// Pipeline starts the workers of a pipeline feeding the installer. Nodes are passed in
+// with Add, usually as ResolveOptions.Settled, and Wait must be called once resolution ends.
+func (in *Installer) Pipeline() *Pipeline {
+	fetchers, unpackers := in.Jobs, runtime.NumCPU()
+	p := &Pipeline{
+		in:     in,
+		fetch:  make(chan *DependencyNode, fetchers*2),
+		unpack: make(chan *DependencyNode, unpackers*2),
+		seen:   make(map[string]bool, 100),
+	}
+	p.fetched.Add(fetchers)
+	for i := 0; i < fetchers; i++ {
+		go p.fetchWorker()
+	}
+	p.done.Add(unpackers)
+	for i := 0; i < unpackers; i++ {
+		go p.unpackWorker()
+	}
+	return p
+}
+
+// Add queues a settled node, blocking while the fetch stage is full
+func (p *Pipeline) Add(n *DependencyNode) {
+	id := n.Name + "@" + n.Version
+	p.mx.Lock()
+	seen := p.seen[id]
+	p.seen[id] = true
+	p.mx.Unlock()
+	if seen {
+		return
+	}
+	//optional packages for other platforms are kept in the tree, but never installed,
+	//and omitted kinds might well be left out too
+	if p.in.Platform.checkPlatform(id, n.PlatformSupport) != nil || p.in.omitted(n) {
+		return
+	}
+	p.fetch <- n
+}
+
+// Wait lets the queued nodes through every stage, then stops the workers
+func (p *Pipeline) Wait() {
+	close(p.fetch)
+	p.fetched.Wait()
+	close(p.unpack)
+	p.done.Wait()
+}
+
+func (p *Pipeline) fetchWorker() {
+	defer p.fetched.Done()
+	for n := range p.fetch {
+		_, err := p.in.Cache.Tarball(n)
+		if err != nil {
+			log.Debugf("Failed to fetch %s@%s ahead of installing: %s", n.Name, n.Version, err.Error())
+			continue
+		}
+		if p.in.Store != nil {
+			p.unpack <- n
+		}
+	}
+}
+
+func (p *Pipeline) unpackWorker() {
+	defer p.done.Done()
+	for n := range p.unpack {
+		if _, err := p.in.Store.index(n); err == nil {
+			continue
+		}
+		src, err := p.in.Cache.Tarball(n)
+		if err == nil {
+			_, err = p.in.Store.add(n, src)
+		}
+		if err != nil {
+			log.Debugf("Failed to unpack %s@%s ahead of installing: %s", n.Name, n.Version, err.Error())
+		}
+	}
+}
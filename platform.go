@@ -0,0 +1,163 @@
+package main
+
+import (
+	"encoding/json"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+// A Platform is what packages are resolved for, checked against their
+// engines, os, cpu and libc fields. Empty fields are not checked.
+type Platform struct {
+	Node string
+	OS   string
+	CPU  string
+	Libc string
+}
+
+// PlatformSupport is the os, cpu and libc a package declares it works on,
+// entries starting with '!' rule one out
+type PlatformSupport struct {
+	OS   platformList `json:"os,omitempty"`
+	CPU  platformList `json:"cpu,omitempty"`
+	Libc platformList `json:"libc,omitempty"`
+}
+
+// A PlatformError means a package doesn't support the target platform
+type PlatformError struct {
+	Package string
+	Field   string
+	Wanted  []string
+	Current string
+}
+
+func (e *PlatformError) Error() string {
+	if e.Field == "node" {
+		return "Unsupported engine for " + e.Package + ": wanted node " + e.Wanted[0] + " (current: " + e.Current + ")"
+	}
+	return "Unsupported platform for " + e.Package + ": wanted " + e.Field + " " +
+		strings.Join(e.Wanted, ",") + " (current: " + e.Current + ")"
+}
+
+// platformList is the os, cpu or libc field of a package, which may also be a single string
+type platformList []string
+
+func (l *platformList) UnmarshalJSON(data []byte) error {
+	var list []string
+	if json.Unmarshal(data, &list) == nil {
+		*l = list
+		return nil
+	}
+	var s string
+	if json.Unmarshal(data, &s) == nil {
+		*l = platformList{s}
+	}
+	//anything else is too broken to enforce
+	return nil
+}
+
+// engineMap is the engines field of a package, old packages sometimes have an array instead
+type engineMap map[string]string
+
+func (m *engineMap) UnmarshalJSON(data []byte) error {
+	var engines map[string]string
+	if json.Unmarshal(data, &engines) == nil {
+		*m = engines
+	}
+	return nil
+}
+
+var nodeOS = map[string]string{"windows": "win32"}
+var nodeCPU = map[string]string{"amd64": "x64", "386": "ia32"}
+
+// CurrentPlatform describes the machine fpm is running on, using node's names.
+// The node version is left empty, see NodeVersion.
+func CurrentPlatform() Platform {
+	p := Platform{OS: runtime.GOOS, CPU: runtime.GOARCH}
+	if name := nodeOS[p.OS]; name != "" {
+		p.OS = name
+	}
+	if name := nodeCPU[p.CPU]; name != "" {
+		p.CPU = name
+	}
+	if p.OS == "linux" {
+		p.Libc = "glibc"
+		if musl, _ := filepath.Glob("/lib/ld-musl-*"); len(musl) > 0 {
+			p.Libc = "musl"
+		}
+	}
+	return p
+}
+
+// NodeVersion returns the version of node on the PATH, or an empty string without one
+func NodeVersion() string {
+	out, err := exec.Command("node", "--version").Output()
+	if err != nil {
+		return ""
+	}
+	return strings.TrimPrefix(strings.TrimSpace(string(out)), "v")
+}
+
+// matchPlatform checks a value against a list like ["linux", "darwin"] or ["!win32"]
+func matchPlatform(list []string, value string) bool {
+	if len(list) == 0 || value == "" {
+		return true
+	}
+	allowed := true
+	for _, v := range list {
+		if strings.HasPrefix(v, "!") {
+			if v[1:] == value {
+				return false
+			}
+			continue
+		}
+		//any positive entry means only those are allowed
+		allowed = false
+	}
+	if allowed {
+		return true
+	}
+	for _, v := range list {
+		if v == value || v == "any" {
+			return true
+		}
+	}
+	return false
+}
+
+// checkPlatform returns a *PlatformError if a package can't be installed on the platform
+func (p Platform) checkPlatform(id string, s PlatformSupport) error {
+	if !matchPlatform(s.OS, p.OS) {
+		return &PlatformError{id, "os", s.OS, p.OS}
+	}
+	if !matchPlatform(s.CPU, p.CPU) {
+		return &PlatformError{id, "cpu", s.CPU, p.CPU}
+	}
+	if !matchPlatform(s.Libc, p.Libc) {
+		return &PlatformError{id, "libc", s.Libc, p.Libc}
+	}
+	return nil
+}
+
+// checkEngines returns an error if the package wants a different version of node
+func (p Platform) checkEngines(pkg *Package) error {
+	rng := pkg.Engines["node"]
+	if p.Node == "" || rng == "" {
+		return nil
+	}
+	req, err := NewSemverRequirements(rng)
+	if err != nil {
+		//unparseable engines are ignored, like npm does
+		return nil
+	}
+	sv, err := parseDown(p.Node)
+	if err != nil {
+		return nil
+	}
+	if !req.SatisfiedBy(sv) {
+		return &PlatformError{pkg.Name + "@" + pkg.Version, "node", []string{rng}, p.Node}
+	}
+	return nil
+}
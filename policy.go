@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// ScriptPolicyName is the file, next to package.json, listing the packages allowed to run install scripts
+const ScriptPolicyName = "fpm-allow-scripts.txt"
+
+// A ScriptPolicy lists the packages whose install scripts may run, as a "name@range"
+// or just a name for any version on each line. Anything after a '#' is a comment.
+type ScriptPolicy struct {
+	rules []scriptRule
+}
+
+type scriptRule struct {
+	name string
+
+	//nil for any version
+	req *SemverRequirements
+}
+
+// ReadScriptPolicy reads a policy file
+func ReadScriptPolicy(path string) (*ScriptPolicy, error) {
+	fd, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+	p := new(ScriptPolicy)
+	s := bufio.NewScanner(fd)
+	for line := 1; s.Scan(); line++ {
+		spec := s.Text()
+		if i := strings.IndexRune(spec, '#'); i != -1 {
+			spec = spec[:i]
+		}
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
+		name, rng := splitSpec(spec)
+		rule := scriptRule{name: name}
+		if rng != "" {
+			rule.req, err = NewSemverRequirements(rng)
+			if err != nil {
+				return nil, errors.New("Invalid range on line " + strconv.Itoa(line) + " of " + path + ": " + err.Error())
+			}
+		}
+		p.rules = append(p.rules, rule)
+	}
+	return p, s.Err()
+}
+
+// Allows reports if a package may run its install scripts. A nil policy allows everything.
+func (p *ScriptPolicy) Allows(name, version string) bool {
+	if p == nil {
+		return true
+	}
+	v, err := parseDown(version)
+	for _, r := range p.rules {
+		if r.name == name && (r.req == nil || (err == nil && r.req.SatisfiedBy(v))) {
+			return true
+		}
+	}
+	return false
+}
+
+// hasInstallScript reports if a package runs anything when installed, going by the
+// registry's hasInstallScript flag or the scripts themselves
+func (p *Package) hasInstallScript() bool {
+	if p.HasInstallScript || p.Gypfile {
+		return true
+	}
+	for _, event := range installEvents {
+		if p.Scripts[event] != "" {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestScriptPolicy_Allows(t *testing.T) {
+	dir := _testDir(t, "fpm-policy")
+	path := filepath.Join(dir, ScriptPolicyName)
+	err := ioutil.WriteFile(path, []byte("# native modules\nesbuild@>=0.18.0 <1  # pinned\n\n  @scope/addon\nfsevents@~2.3.2\n"), 0644)
+	if err != nil {
+		t.Fatalf("Failed to write policy: %s\n", err.Error())
+	}
+	p, err := ReadScriptPolicy(path)
+	if err != nil {
+		t.Fatalf("Failed to read policy: %s\n", err.Error())
+	}
+	cases := []struct {
+		name, version string
+		allowed       bool
+	}{
+		{"esbuild", "0.19.2", true},
+		{"esbuild", "0.17.0", false},
+		{"esbuild", "1.0.0", false},
+		{"@scope/addon", "5.0.0", true},
+		{"fsevents", "2.3.3", true},
+		{"fsevents", "2.4.0", false},
+		{"native", "1.0.0", false},
+	}
+	for _, c := range cases {
+		if p.Allows(c.name, c.version) != c.allowed {
+			t.Errorf("Expected %s@%s allowed to be %t", c.name, c.version, c.allowed)
+		}
+	}
+	if !(*ScriptPolicy)(nil).Allows("native", "1.0.0") {
+		t.Errorf("Expected no policy to allow everything")
+	}
+
+	err = ioutil.WriteFile(path, []byte("esbuild@not-a-range\n"), 0644)
+	if err != nil {
+		t.Fatalf("Failed to write policy: %s\n", err.Error())
+	}
+	_, err = ReadScriptPolicy(path)
+	if err == nil {
+		t.Errorf("Expected an invalid range to fail")
+	}
+}
+
+func TestOptions_policy(t *testing.T) {
+	dir := _testDir(t, "fpm-policy")
+	o := &options{dir: dir}
+	pkg := new(Package)
+	p, err := o.policy(pkg)
+	if err != nil || p != nil {
+		t.Errorf("Expected no policy without a file")
+	}
+
+	//strict mode fails closed when the file is missing, or misnamed
+	err = ioutil.WriteFile(filepath.Join(dir, "fpm-allow-script.txt"), []byte("esbuild\n"), 0644)
+	if err != nil {
+		t.Fatalf("Failed to write policy: %s\n", err.Error())
+	}
+	o.strictScripts = true
+	p, err = o.policy(pkg)
+	if err != nil || p == nil || p.Allows("esbuild", "1.0.0") {
+		t.Errorf("Expected -strict-scripts to allow nothing without a file")
+	}
+	o.strictScripts, pkg.Fpm.StrictScripts = false, true
+	p, err = o.policy(pkg)
+	if err != nil || p == nil || p.Allows("esbuild", "1.0.0") {
+		t.Errorf("Expected fpm.strictScripts to allow nothing without a file")
+	}
+
+	err = ioutil.WriteFile(filepath.Join(dir, ScriptPolicyName), []byte("esbuild\n"), 0644)
+	if err != nil {
+		t.Fatalf("Failed to write policy: %s\n", err.Error())
+	}
+	p, err = o.policy(pkg)
+	if err != nil || !p.Allows("esbuild", "1.0.0") {
+		t.Errorf("Expected the project's policy to be read")
+	}
+	o.scriptPolicy = filepath.Join(dir, "missing.txt")
+	_, err = o.policy(pkg)
+	if err == nil {
+		t.Errorf("Expected a missing -script-policy file to fail")
+	}
+}
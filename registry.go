@@ -6,8 +6,11 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"net/url"
 	"sort"
+	"strings"
 	"sync"
+	"time"
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/blang/semver"
@@ -17,32 +20,123 @@ type Registry struct {
 	baseURL    string
 	cache      packageCache
 	fetchQueue chan packageDataRequest
+
+	//when set, versions published after it are ignored, as if resolving on that date
+	Before time.Time
+
+	//versions younger than this are passed over by LatestCompatablePackageVersion,
+	//except for packages in ReleaseAgeExempt
+	MinReleaseAge    time.Duration
+	ReleaseAgeExempt map[string]bool
+
+	warnMx sync.Mutex
+	warned map[string]bool
 }
 
 type packageCache map[string]*repoPackageData
 type packageDataRequest struct {
-	ch   chan *repoPackageData
+	ch   chan packageDataResult
+	name string
+}
+type packageDataResult struct {
 	name string
+	data *repoPackageData
+	err  error
 }
 
 type repoPackageData struct {
-	Tags           map[string]string `json:"dist-tags"`
-	Versions       map[string]*Package
-	Name           string
+	Tags     map[string]string `json:"dist-tags"`
+	Versions map[string]*Package
+	Name     string
+	//publish dates by version, along with "created" and "modified"
+	Time           map[string]string
 	sortedVersions semver.Versions
 }
 
+// published returns when a version was published, if the registry says
+func (p *repoPackageData) published(version string) (time.Time, bool) {
+	t, err := time.Parse(time.RFC3339, p.Time[version])
+	return t, err == nil
+}
+
+// dropAfter removes versions published after a date, along with tags pointing at them.
+// If latest goes, it moves to the highest release left.
+func (p *repoPackageData) dropAfter(before time.Time) {
+	if len(p.Time) == 0 {
+		log.Warnf("No publish dates for %s, using all versions", p.Name)
+		return
+	}
+	for v := range p.Versions {
+		t, ok := p.published(v)
+		if !ok || t.After(before) {
+			delete(p.Versions, v)
+		}
+	}
+	for tag, v := range p.Tags {
+		if p.Versions[v] == nil {
+			delete(p.Tags, tag)
+		}
+	}
+	if p.Tags["latest"] != "" {
+		return
+	}
+	var latest *semver.Version
+	for v := range p.Versions {
+		sv, err := semver.New(v)
+		if err != nil || len(sv.Pre) > 0 {
+			continue
+		}
+		if latest == nil || sv.GT(*latest) {
+			latest = sv
+		}
+	}
+	if latest != nil {
+		if p.Tags == nil {
+			p.Tags = make(map[string]string, 1)
+		}
+		p.Tags["latest"] = latest.String()
+	}
+}
+
 type Package struct {
 	Name                 string
 	Version              string
+	Description          string
+	Deprecated           string
+	Files                []string
 	Dependencies         DependencyMap
 	DevDependencies      DependencyMap
 	OptionalDependencies DependencyMap
 	PeerDependencies     DependencyMap
-	Dist                 struct {
-		Tarball string
-		Shasum  string
+	PeerDependenciesMeta map[string]struct {
+		Optional bool
+	}
+	Scripts     map[string]string
+	Bin         binMap
+	Directories struct {
+		Bin string
+	}
+	Engines     engineMap
+	Overrides   json.RawMessage
+	Resolutions json.RawMessage
+	Dist        struct {
+		Tarball   string
+		Shasum    string
+		Integrity string
+	}
+
+	//set by the registry for packages with install scripts or a binding.gyp
+	HasInstallScript bool
+	Gypfile          bool
+
+	//settings for fpm itself, only read from the project's package.json
+	Fpm struct {
+		Layout string
+
+		//when set, a missing script policy allows no install scripts instead of all
+		StrictScripts bool
 	}
+	PlatformSupport
 }
 
 type DependencyMap map[string]*SemverRequirements
@@ -126,14 +220,86 @@ func (r *Registry) LatestCompatablePackageVersion(name string, req SatisfiesChec
 	if err != nil {
 		return version, err
 	}
+	var skipped []string
 	for _, v := range versions {
-		if req.SatisfiedBy(v) {
-			return v, nil
+		if !req.SatisfiedBy(v) {
+			continue
+		}
+		if r.quarantined(name, v) {
+			skipped = append(skipped, v.String())
+			continue
+		}
+		r.warnHeldBack(name, v, skipped)
+		return v, nil
+	}
+	if len(skipped) > 0 {
+		return version, errors.New("No compatable versions old enough for: " + name + "@" + req.String() +
+			", held back: " + strings.Join(skipped, ", "))
+	}
+	return version, errors.New("No compatable versions available for: " + name + "@" + req.String())
+}
+
+// LowestCompatablePackageVersion returns the oldest version satisfying the requirement
+func (r *Registry) LowestCompatablePackageVersion(name string, req SatisfiesChecker) (version semver.Version, err error) {
+	versions, err := r.PackageVersions(name)
+	if err != nil {
+		return version, err
+	}
+	var skipped []string
+	for i := len(versions) - 1; i >= 0; i-- {
+		if !req.SatisfiedBy(versions[i]) {
+			continue
 		}
+		if r.quarantined(name, versions[i]) {
+			skipped = append(skipped, versions[i].String())
+			continue
+		}
+		r.warnHeldBack(name, versions[i], skipped)
+		return versions[i], nil
+	}
+	if len(skipped) > 0 {
+		return version, errors.New("No compatable versions old enough for: " + name + "@" + req.String() +
+			", held back: " + strings.Join(skipped, ", "))
 	}
 	return version, errors.New("No compatable versions available for: " + name + "@" + req.String())
 }
 
+// warnHeldBack tells the user once that a pick passed over versions too new for MinReleaseAge
+func (r *Registry) warnHeldBack(name string, v semver.Version, skipped []string) {
+	if len(skipped) == 0 {
+		return
+	}
+	r.warnOnce(name+"@"+v.String(), "Using %s@%s, skipped versions younger than the minimum release age: %s",
+		name, v.String(), strings.Join(skipped, ", "))
+}
+
+// quarantined reports if a version is too new to be used under MinReleaseAge.
+// Versions without a publish date are let through.
+func (r *Registry) quarantined(name string, v semver.Version) bool {
+	if r.MinReleaseAge <= 0 || r.ReleaseAgeExempt[name] {
+		return false
+	}
+	p, err := r.packageData(name)
+	if err != nil {
+		return false
+	}
+	t, ok := p.published(v.String())
+	return ok && time.Since(t) < r.MinReleaseAge
+}
+
+func (r *Registry) warnOnce(key string, format string, args ...interface{}) {
+	r.warnMx.Lock()
+	defer r.warnMx.Unlock()
+	if r.warned == nil {
+		r.warned = make(map[string]bool, 10)
+	}
+	if r.warned[key] {
+		return
+	}
+	r.warned[key] = true
+	log.Warnf(format, args...)
+}
+
 func (r *Registry) PackageByVersion(name string, version string) (*Package, error) {
 	p, err := r.packageData(name)
 	if err != nil {
@@ -145,6 +311,15 @@ func (r *Registry) PackageByVersion(name string, version string) (*Package, erro
 	return p.Versions[version], nil
 }
 
+// PackageTags returns the dist-tags (e.g. "latest") of a package
+func (r *Registry) PackageTags(name string) (map[string]string, error) {
+	p, err := r.packageData(name)
+	if err != nil {
+		return nil, err
+	}
+	return p.Tags, nil
+}
+
 func (r *Registry) PackageVersions(name string) (semver.Versions, error) {
 	p, err := r.packageData(name)
 	if err != nil {
@@ -155,18 +330,19 @@ func (r *Registry) PackageVersions(name string) (semver.Versions, error) {
 
 func (r *Registry) dataFetchLoop() {
 	log.Debugln("Started loop")
-	pending := make(map[string][]chan *repoPackageData, 100)
-	complete := make(chan *repoPackageData, 100)
+	pending := make(map[string][]chan packageDataResult, 100)
+	failed := make(map[string]error, 10)
+	complete := make(chan packageDataResult, 100)
 	for {
 		select {
 		case req := <-r.fetchQueue:
 			log.Debugln("Processing", req.name, "from queue.")
 			//if already cached and good to go then return
-			if r.cache[req.name] != nil {
+			if r.cache[req.name] != nil || failed[req.name] != nil {
 				if req.ch == nil {
 					continue
 				}
-				req.ch <- r.cache[req.name]
+				req.ch <- packageDataResult{req.name, r.cache[req.name], failed[req.name]}
 				//if already being fetch then add the return channel
 			} else if pending[req.name] != nil {
 				if req.ch == nil {
@@ -175,26 +351,28 @@ func (r *Registry) dataFetchLoop() {
 				pending[req.name] = append(pending[req.name], req.ch)
 				//initiate a new fetch
 			} else {
-				pending[req.name] = make([]chan *repoPackageData, 0, 20)
+				pending[req.name] = make([]chan packageDataResult, 0, 20)
 				if req.ch != nil {
 					pending[req.name] = append(pending[req.name], req.ch)
 				}
 				go func(name string) {
-					data, err := r.fetchPackageData(req.name)
-					if err != nil {
-						log.Fatalln(err)
-					}
-					complete <- data
+					data, err := r.fetchPackageData(name)
+					complete <- packageDataResult{name, data, err}
 				}(req.name)
 			}
-		case data := <-complete:
-			log.Debugln("Completed", data.Name)
-			r.cache[data.Name] = data
-			if pending[data.Name] != nil {
-				for _, v := range pending[data.Name] {
-					v <- data
+		case res := <-complete:
+			if res.err != nil {
+				log.Debugln("Failed", res.name+":", res.err)
+				failed[res.name] = res.err
+			} else {
+				log.Debugln("Completed", res.name)
+				r.cache[res.name] = res.data
+			}
+			if pending[res.name] != nil {
+				for _, v := range pending[res.name] {
+					v <- res
 				}
-				pending[data.Name] = nil
+				pending[res.name] = nil
 			}
 		}
 	}
@@ -212,14 +390,21 @@ func (r *Registry) cacheAll(deps DependencyMap) {
 	wg.Wait()
 }
 
+// prefetch starts fetching package data in the background, without waiting on it
+func (r *Registry) prefetch(name string) {
+	r.fetchQueue <- packageDataRequest{nil, name}
+}
+
 func (r *Registry) packageData(name string) (*repoPackageData, error) {
-	ch := make(chan *repoPackageData, 1)
+	ch := make(chan packageDataResult, 1)
 	r.fetchQueue <- packageDataRequest{ch, name}
-	return <-ch, nil
+	res := <-ch
+	return res.data, res.err
 }
 
 func (r *Registry) fetchPackageData(name string) (*repoPackageData, error) {
-	fullURL := r.baseURL + name
+	//scoped packages keep the '@' but need the '/' escaped
+	fullURL := r.baseURL + strings.Replace(url.QueryEscape(name), "%40", "@", 1)
 	log.Debugf("Fetch data for '%s' from: %s", name, fullURL)
 	res, err := http.Get(fullURL)
 	if err != nil {
@@ -236,6 +421,9 @@ func (r *Registry) fetchPackageData(name string) (*repoPackageData, error) {
 	if err != nil {
 		return nil, err
 	}
+	if !r.Before.IsZero() {
+		p.dropAfter(r.Before)
+	}
 	p.sortedVersions = make(semver.Versions, 0, len(p.Versions))
 	compareLatest := true
 	latest, err := semver.New(p.Tags["latest"])
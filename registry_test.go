@@ -0,0 +1,205 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha1"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testPackages maps "name@version" to its dependencies. Keys starting with a dot,
+// which no package name can, set other fields of the version instead:
+// ".published" its publish date in RFC 3339, and ".postinstall" a postinstall script.
+type testPackages map[string]map[string]string
+
+// _testRegistry serves packuments and tarballs for the given packages.
+// The highest version of each package is tagged as latest.
+func _testRegistry(t *testing.T, pkgs testPackages) (*Registry, *httptest.Server) {
+	docs := make(map[string]map[string]interface{}, len(pkgs))
+	tarballs := make(map[string][]byte, len(pkgs))
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if data, ok := tarballs[req.URL.Path]; ok {
+			w.Write(data)
+			return
+		}
+		name, err := url.QueryUnescape(strings.TrimPrefix(req.URL.EscapedPath(), "/"))
+		if err != nil || docs[name] == nil {
+			http.NotFound(w, req)
+			return
+		}
+		json.NewEncoder(w).Encode(docs[name])
+	}))
+
+	for spec, fields := range pkgs {
+		name, version := splitSpec(spec)
+		deps := make(map[string]string, len(fields))
+		for k, v := range fields {
+			if !strings.HasPrefix(k, ".") {
+				deps[k] = v
+			}
+		}
+		if docs[name] == nil {
+			docs[name] = map[string]interface{}{
+				"name":      name,
+				"dist-tags": map[string]string{"latest": version},
+				"versions":  map[string]interface{}{},
+				"time":      map[string]string{},
+			}
+		}
+		if date := fields[".published"]; date != "" {
+			docs[name]["time"].(map[string]string)[version] = date
+		}
+		latest, _ := parseDown(docs[name]["dist-tags"].(map[string]string)["latest"])
+		if sv, _ := parseDown(version); sv.GT(latest) {
+			docs[name]["dist-tags"].(map[string]string)["latest"] = version
+		}
+
+		path := "/tarballs/" + packTarballName(name, version)
+		manifest := map[string]interface{}{"name": name, "version": version}
+		if fields[".postinstall"] != "" {
+			manifest["scripts"] = map[string]string{"postinstall": fields[".postinstall"]}
+		}
+		manifestData, _ := json.Marshal(manifest)
+		data := _testTarball(t, map[string]string{
+			"package.json": string(manifestData),
+			"index.js":     "module.exports = '" + spec + "'\n",
+		})
+		tarballs[path] = data
+		sum := sha1.Sum(data)
+		sum512 := sha512.Sum512(data)
+		docs[name]["versions"].(map[string]interface{})[version] = map[string]interface{}{
+			"name":             name,
+			"version":          version,
+			"dependencies":     deps,
+			"hasInstallScript": fields[".postinstall"] != "",
+			"dist": map[string]string{
+				"tarball":   srv.URL + path,
+				"shasum":    hex.EncodeToString(sum[:]),
+				"integrity": "sha512-" + base64.StdEncoding.EncodeToString(sum512[:]),
+			},
+		}
+	}
+	return NewRegistry(srv.URL), srv
+}
+
+// _testAgo formats the time d ago for ".published" in testPackages
+func _testAgo(d time.Duration) string {
+	return time.Now().Add(-d).Format(time.RFC3339)
+}
+
+// _testTarball builds a gzipped package tarball holding the given files
+func _testTarball(t *testing.T, files map[string]string) []byte {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	for _, name := range sortedStringKeys(files) {
+		err := tw.WriteHeader(&tar.Header{Name: "package/" + name, Mode: 0644, Size: int64(len(files[name])), Typeflag: tar.TypeReg})
+		if err != nil {
+			t.Fatalf("Failed to write tar header: %s\n", err.Error())
+		}
+		tw.Write([]byte(files[name]))
+	}
+	tw.Close()
+	gz.Close()
+	return buf.Bytes()
+}
+
+func TestRegistry_scoped(t *testing.T) {
+	r, srv := _testRegistry(t, testPackages{
+		"@scope/pkg@1.0.0": nil,
+		"@scope/pkg@1.2.0": nil,
+	})
+	defer srv.Close()
+
+	v, err := r.LatestPackageVersion("@scope/pkg")
+	if err != nil {
+		t.Fatalf("Failed to get latest version: %s\n", err.Error())
+	}
+	if v.String() != "1.2.0" {
+		t.Errorf("Expected latest version '1.2.0' but got '%s'", v.String())
+	}
+}
+
+func TestRegistry_before(t *testing.T) {
+	day := func(d int) time.Time {
+		return time.Date(2020, time.January, d, 12, 0, 0, 0, time.UTC)
+	}
+	r, srv := _testRegistry(t, testPackages{
+		"a@1.0.0": {".published": day(1).Format(time.RFC3339)},
+		"a@1.1.0": {".published": day(10).Format(time.RFC3339)},
+		"a@2.0.0": {".published": day(20).Format(time.RFC3339)},
+	})
+	defer srv.Close()
+	r.Before = day(15)
+
+	versions, err := r.PackageVersions("a")
+	if err != nil {
+		t.Fatalf("Failed to get versions: %s\n", err.Error())
+	}
+	if len(versions) != 2 || versions[0].String() != "1.1.0" {
+		t.Errorf("Expected versions [1.1.0 1.0.0] but got %v", versions)
+	}
+	tags, err := r.PackageTags("a")
+	if err != nil {
+		t.Fatalf("Failed to get tags: %s\n", err.Error())
+	}
+	if tags["latest"] != "1.1.0" {
+		t.Errorf("Expected latest to move to '1.1.0' but got '%s'", tags["latest"])
+	}
+}
+
+func TestRegistry_minReleaseAge(t *testing.T) {
+	r, srv := _testRegistry(t, testPackages{
+		"a@1.0.0": {".published": _testAgo(30 * 24 * time.Hour)},
+		"a@1.1.0": {".published": _testAgo(2 * 24 * time.Hour)},
+		"a@1.2.0": {".published": _testAgo(time.Hour)},
+		"b@1.0.0": {".published": _testAgo(time.Hour)},
+	})
+	defer srv.Close()
+	r.MinReleaseAge = 7 * 24 * time.Hour
+	r.ReleaseAgeExempt = map[string]bool{"b": true}
+
+	check := func(name, rng, expected string) {
+		req, err := NewSemverRequirements(rng)
+		if err != nil {
+			t.Fatalf("Bad test, failed to parse requirement '%s': %s\n", rng, err.Error())
+		}
+		v, err := r.LatestCompatablePackageVersion(name, req)
+		if expected == "" {
+			if err == nil {
+				t.Errorf("Expected no version of %s@%s but got '%s'", name, rng, v.String())
+			}
+			return
+		}
+		if err != nil {
+			t.Fatalf("Failed to get version of %s@%s: %s\n", name, rng, err.Error())
+		}
+		if v.String() != expected {
+			t.Errorf("Expected %s@%s to pick '%s' but got '%s'", name, rng, expected, v.String())
+		}
+	}
+	check("a", "^1", "1.0.0")
+	check("a", "^1.1.0", "")
+	check("b", "^1", "1.0.0")
+	if !r.warned["a@1.0.0"] {
+		t.Errorf("Expected a warning about the versions of a held back")
+	}
+
+	req, err := NewSemverRequirements("^1.1.0")
+	if err != nil {
+		t.Fatalf("Bad test, failed to parse requirement: %s\n", err.Error())
+	}
+	if v, err := r.LowestCompatablePackageVersion("a", req); err == nil || !strings.Contains(err.Error(), "held back: 1.1.0, 1.2.0") {
+		t.Errorf("Expected the lowest version of a@^1.1.0 to be held back but got '%s', %v", v.String(), err)
+	}
+}
@@ -0,0 +1,433 @@
+package main
+
+import (
+	"errors"
+	"sort"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/blang/semver"
+)
+
+type pendingDependency struct {
+	parent *DependencyNode
+	name   string
+	req    *SemverRequirements
+	kind   int
+
+	overrides *overrideContext
+}
+
+// ResolveOptions change how CalculateTree builds a tree
+type ResolveOptions struct {
+	//don't install peer dependencies, or fail on conflicts between them, like npm 6 did
+	LegacyPeerDeps bool
+
+	//use the backtracking solver, picking one version of each package for a flat tree
+	Solver bool
+
+	//pick the lowest version matching each range instead of the highest, to find
+	//packages whose declared lower bounds are wrong
+	PreferLowest bool
+
+	//pass over deprecated versions when the range allows one that isn't
+	PreferNonDeprecated bool
+
+	//what to resolve for, packages that don't support it fail unless optional
+	Target Platform
+
+	//fail instead of warning when a package wants a different node version
+	EngineStrict bool
+
+	//a previous resolution, whose versions are kept wherever they still satisfy
+	Locked *DependencyTree
+
+	//called with every node once its version is picked, to start fetching it
+	//early, see Pipeline. Nodes dropped later on, or picks the solver backtracks
+	//from, are still passed in. Their Dev, Optional and Peer flags are only
+	//how they're needed so far.
+	Settled func(*DependencyNode)
+}
+
+// lockedVersions lists the versions of each package in a tree, highest first
+func lockedVersions(t *DependencyTree) map[string][]semver.Version {
+	m := make(map[string][]semver.Version, 100)
+	if t == nil {
+		return m
+	}
+	t.Walk(func(n *DependencyNode) {
+		sv, err := parseDown(n.Version)
+		if err == nil {
+			m[n.Name] = append(m[n.Name], sv)
+		}
+	})
+	for _, versions := range m {
+		sort.Sort(sort.Reverse(semver.Versions(versions)))
+	}
+	return m
+}
+
+type resolver struct {
+	ResolveOptions
+	r       *Registry
+	t       *DependencyTree
+	queue   []pendingDependency
+	removed map[*DependencyNode]bool
+	locked  map[string][]semver.Version
+
+	//the nearest nodes brought in as optional dependencies that each node is there for,
+	//which get dropped along with everything under them if it fails. Required nodes have none.
+	optional map[*DependencyNode]map[*DependencyNode]bool
+
+	//what each node queued, to queue again once it's needed for more than before
+	queued map[*DependencyNode][]pendingDependency
+}
+
+// CalculateTree resolves the dependencies of the root package into a tree of nodes.
+//
+// Dev dependencies are only followed for the root package, failures within optional
+// dependencies are logged and skipped, and peer dependencies are installed next to the
+// package asking for them. Peer dependencies that conflict with a version
+// already in place result in a *PeerConflictError.
+//
+// With the Solver option a single version of every package is picked instead, see solveTree.
+func CalculateTree(r *Registry, root *Package, opts ResolveOptions) (*DependencyTree, error) {
+	if opts.Solver {
+		return solveTree(r, root, opts)
+	}
+	res := &resolver{
+		ResolveOptions: opts,
+		r:              r,
+		t:              new(DependencyTree),
+		queue:          make([]pendingDependency, 0, 100),
+		removed:        make(map[*DependencyNode]bool, 10),
+		locked:         lockedVersions(opts.Locked),
+		optional:       make(map[*DependencyNode]map[*DependencyNode]bool, 10),
+		queued:         make(map[*DependencyNode][]pendingDependency, 100),
+	}
+	t := res.t
+	t.Nodes = make(map[string]*DependencyNode, len(root.Dependencies))
+	t.Requires = make(map[string]string, len(root.Dependencies))
+	t.DevRequires = make(map[string]string, len(root.DevDependencies))
+	t.OptionalRequires = make(map[string]string, len(root.OptionalDependencies))
+	rules, err := parseOverrides(root)
+	if err != nil {
+		return nil, err
+	}
+	ctx := &overrideContext{rules, nil}
+
+	for _, name := range sortedReqKeys(root.Dependencies) {
+		//npm lists optional dependencies under dependencies too
+		if root.OptionalDependencies[name] != nil {
+			continue
+		}
+		res.enqueue(nil, name, root.Dependencies[name], depProd, ctx)
+	}
+	for _, name := range sortedReqKeys(root.OptionalDependencies) {
+		res.enqueue(nil, name, root.OptionalDependencies[name], depOptional, ctx)
+	}
+	for _, name := range sortedReqKeys(root.DevDependencies) {
+		if t.Requires[name] != "" || t.OptionalRequires[name] != "" {
+			continue
+		}
+		res.enqueue(nil, name, root.DevDependencies[name], depDev, ctx)
+	}
+
+	for len(res.queue) > 0 {
+		dep := res.queue[0]
+		res.queue = res.queue[1:]
+		if res.dropped(dep.parent) {
+			continue
+		}
+		err := res.resolve(dep)
+		if err == nil {
+			continue
+		}
+		skip := skipLog(err)
+		if dep.kind == depOptional {
+			skip("Skipping optional dependency %s@%s: %s", dep.name, dep.req.Range(), err.Error())
+			continue
+		}
+		if res.optional[dep.parent] == nil {
+			return nil, err
+		}
+		for o := range res.optional[dep.parent] {
+			if res.removed[o] {
+				continue
+			}
+			skip("Skipping optional dependency %s@%s, failed to resolve %s: %s", o.Name, o.Version, dep.name, err.Error())
+			res.removed[o] = true
+			if nodes := t.nodesAt(o.Parent); nodes[o.Name] == o {
+				delete(nodes, o.Name)
+			}
+		}
+	}
+
+	t.prune()
+	t.markFlags()
+	t.warnDeprecated()
+	if len(t.PeerConflicts) > 0 {
+		return nil, &PeerConflictError{t, t.PeerConflicts}
+	}
+	return t, nil
+}
+
+// dropped reports if a node is only there for optional dependencies that were dropped
+func (res *resolver) dropped(n *DependencyNode) bool {
+	if res.optional[n] == nil {
+		return false
+	}
+	for o := range res.optional[n] {
+		if !res.removed[o] {
+			return false
+		}
+	}
+	return true
+}
+
+// need records what a node is needed for when another dependency reuses it. Anything
+// it queued is queued again, so that what it brought in is needed for the same.
+func (res *resolver) need(n *DependencyNode, dep pendingDependency) error {
+	tags := res.optional[n]
+	if tags == nil {
+		return nil
+	}
+	merged := make(map[*DependencyNode]bool, len(tags)+1)
+	switch {
+	case dep.kind == depOptional:
+		merged[n] = true
+	case res.optional[dep.parent] == nil:
+		//required now, so it has to work on the target too
+		err := res.Target.checkPlatform(n.Name+"@"+n.Version, n.PlatformSupport)
+		if err != nil {
+			return err
+		}
+		delete(res.optional, n)
+		res.queue = append(res.queue, res.queued[n]...)
+		return nil
+	default:
+		for o := range res.optional[dep.parent] {
+			merged[o] = true
+		}
+	}
+	grown := false
+	for o := range merged {
+		grown = grown || !tags[o]
+	}
+	if !grown {
+		return nil
+	}
+	for o := range tags {
+		merged[o] = true
+	}
+	res.optional[n] = merged
+	res.queue = append(res.queue, res.queued[n]...)
+	return nil
+}
+
+// enqueue records a dependency edge and queues it for resolution
+func (res *resolver) enqueue(parent *DependencyNode, name string, req *SemverRequirements, kind int, ctx *overrideContext) {
+	var reqs map[string]string
+	if parent == nil {
+		reqs = res.t.requires(kind)
+	} else {
+		reqs = parent.requires(kind)
+	}
+	reqs[name] = req.Range()
+	res.r.prefetch(name)
+	dep := pendingDependency{parent, name, req, kind, ctx}
+	res.queue = append(res.queue, dep)
+	if parent != nil {
+		res.queued[parent] = append(res.queued[parent], dep)
+	}
+}
+
+// pick chooses the version to use for a range
+func (res *resolver) pick(name string, req *SemverRequirements) (semver.Version, *Package, error) {
+	for _, v := range res.locked[name] {
+		if !req.SatisfiedBy(v) {
+			continue
+		}
+		pkg, err := res.r.PackageByVersion(name, v.String())
+		if err == nil {
+			return v, pkg, nil
+		}
+	}
+
+	pick := res.r.LatestCompatablePackageVersion
+	if res.PreferLowest {
+		pick = res.r.LowestCompatablePackageVersion
+	}
+	vers, err := pick(name, req)
+	if err != nil {
+		return vers, nil, err
+	}
+	pkg, err := res.r.PackageByVersion(name, vers.String())
+	if err != nil || pkg.Deprecated == "" || !res.PreferNonDeprecated {
+		return vers, pkg, err
+	}
+
+	versions, err := res.r.CompatablePackageVersions(name, req)
+	if err != nil {
+		return vers, nil, err
+	}
+	if res.PreferLowest {
+		sort.Sort(semver.Versions(versions))
+	}
+	for _, v := range versions {
+		p, err := res.r.PackageByVersion(name, v.String())
+		if err == nil && p.Deprecated == "" && !res.r.quarantined(name, v) {
+			log.Debugf("Using %s@%s instead of deprecated %s", name, v.String(), vers.String())
+			return v, p, nil
+		}
+	}
+	return vers, pkg, nil
+}
+
+// checkTarget makes sure a package can be used on the target platform,
+// only warning about the node version unless EngineStrict is set.
+// Optional packages are kept whatever their os, cpu and libc so that
+// the lockfile works everywhere, the installer leaves them out instead.
+func (opts ResolveOptions) checkTarget(pkg *Package, optional bool) error {
+	if !optional {
+		err := opts.Target.checkPlatform(pkg.Name+"@"+pkg.Version, pkg.PlatformSupport)
+		if err != nil {
+			return err
+		}
+	}
+	err := opts.Target.checkEngines(pkg)
+	if err != nil && !opts.EngineStrict {
+		log.Warnln(err.Error())
+		return nil
+	}
+	return err
+}
+
+// skipLog returns how loudly to log skipping an optional dependency,
+// platform specific packages are expected to be left out most of the time
+func skipLog(err error) func(string, ...interface{}) {
+	if _, ok := err.(*PlatformError); ok {
+		return log.Infof
+	}
+	return log.Warnf
+}
+
+// warnDeprecated logs every deprecated package along with what pulled it in
+func (n *DependencyTree) warnDeprecated() {
+	n.Walk(func(node *DependencyNode) {
+		if node.Deprecated == "" {
+			return
+		}
+		log.Warnf("%s@%s is deprecated: %s\n  %s", node.Name, node.Version, node.Deprecated, formatPath(n.PathTo(node)))
+	})
+}
+
+func (res *resolver) resolve(dep pendingDependency) error {
+	t := res.t
+	//direct dependencies were checked against overrides up front
+	rule := dep.overrides.lookup(res.r, dep.name, dep.req)
+	overridden := false
+	if rule != nil && rule.value != nil && dep.parent != nil && rule.value.Range() != dep.req.Range() {
+		log.Debugf("Overriding %s@%s with %s for %s", dep.name, dep.req.Range(), rule.value.Range(), dep.parent.Path())
+		dep.req = rule.value
+		dep.parent.requires(dep.kind)[dep.name] = dep.req.Range()
+		overridden = true
+	}
+
+	existing := t.Resolve(dep.parent, dep.name)
+	if existing != nil {
+		sv, err := parseDown(existing.Version)
+		if err == nil && dep.req.SatisfiedBy(sv) {
+			existing.Overridden = existing.Overridden || overridden
+			return res.need(existing, dep)
+		}
+	}
+
+	vers, pkg, err := res.pick(dep.name, dep.req)
+	if err != nil {
+		return err
+	}
+	optional := res.optional[dep.parent]
+	if dep.kind == depOptional {
+		optional = map[*DependencyNode]bool{}
+	}
+	err = res.checkTarget(pkg, optional != nil)
+	if err != nil {
+		return err
+	}
+	node := &DependencyNode{
+		Name:             dep.name,
+		Version:          vers.String(),
+		Tarball:          pkg.Dist.Tarball,
+		Shasum:           pkg.Dist.Shasum,
+		Integrity:        pkg.Dist.Integrity,
+		Requires:         make(map[string]string, len(pkg.Dependencies)),
+		OptionalRequires: make(map[string]string, len(pkg.OptionalDependencies)),
+		PeerRequires:     make(map[string]string, len(pkg.PeerDependencies)),
+		Nodes:            map[string]*DependencyNode{},
+		Overridden:       overridden,
+		HasInstallScript: pkg.hasInstallScript(),
+		Deprecated:       pkg.Deprecated,
+		PlatformSupport:  pkg.PlatformSupport,
+	}
+
+	//peers belong next to the package that wants them, not inside it
+	level := dep.parent
+	if dep.kind == depPeer {
+		level = dep.parent.Parent
+	}
+	if !t.place(level, node) {
+		if dep.kind != depPeer {
+			return errors.New("No room to place " + node.Name + "@" + node.Version + " for " + dep.parent.Path())
+		}
+		t.PeerConflicts = append(t.PeerConflicts, PeerConflict{
+			Package:   dep.parent.Name + "@" + dep.parent.Version,
+			Name:      dep.name,
+			Range:     dep.req.Range(),
+			Found:     existing.Version,
+			dependent: dep.parent,
+			existing:  existing,
+		})
+		return nil
+	}
+	log.Debugln("Placed", node.Name+"@"+node.Version, "at", node.Path())
+	if res.Settled != nil {
+		//how the node is needed so far, for the Pipeline to leave out omitted kinds;
+		//markFlags works it out for good once the tree is done
+		node.Dev = dep.kind == depDev || (dep.parent != nil && dep.parent.Dev)
+		node.Optional = optional != nil
+		node.Peer = dep.kind == depPeer || (dep.parent != nil && dep.parent.Peer)
+		res.Settled(node)
+	}
+
+	if dep.kind == depOptional {
+		optional[node] = true
+	}
+	if optional != nil {
+		res.optional[node] = optional
+	}
+	ctx := dep.overrides.enter(rule)
+	for _, name := range sortedReqKeys(pkg.Dependencies) {
+		if pkg.OptionalDependencies[name] != nil {
+			continue
+		}
+		res.enqueue(node, name, pkg.Dependencies[name], depProd, ctx)
+	}
+	for _, name := range sortedReqKeys(pkg.OptionalDependencies) {
+		res.enqueue(node, name, pkg.OptionalDependencies[name], depOptional, ctx)
+	}
+	for _, name := range sortedReqKeys(pkg.PeerDependencies) {
+		//a regular dependency on the same package takes precedence
+		if node.Requires[name] != "" || node.OptionalRequires[name] != "" {
+			continue
+		}
+		if res.LegacyPeerDeps {
+			continue
+		}
+		if pkg.PeerDependenciesMeta[name].Optional {
+			node.PeerRequires[name] = pkg.PeerDependencies[name].Range()
+			continue
+		}
+		res.enqueue(node, name, pkg.PeerDependencies[name], depPeer, ctx)
+	}
+	return nil
+}
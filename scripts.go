@@ -0,0 +1,464 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// installEvents are the lifecycle scripts run for a dependency once it's installed
+var installEvents = []string{"preinstall", "install", "postinstall"}
+
+// projectPreEvents are the lifecycle scripts run for the project itself before its dependencies are installed
+var projectPreEvents = []string{"preinstall"}
+
+// projectEvents are the lifecycle scripts run for the project itself after an install
+var projectEvents = []string{"install", "postinstall", "preprepare", "prepare", "postprepare"}
+
+// A ScriptRunner runs package.json scripts through a shell
+type ScriptRunner struct {
+	//the shell and the arguments making it run a command, e.g. sh -c
+	Shell []string
+
+	//environment scripts start from, before npm's variables are added
+	Env []string
+
+	Stdout io.Writer
+	Stderr io.Writer
+}
+
+func NewScriptRunner() *ScriptRunner {
+	shell := []string{"sh", "-c"}
+	if runtime.GOOS == "windows" {
+		shell = []string{"cmd", "/d", "/s", "/c"}
+	}
+	return &ScriptRunner{Shell: shell, Env: os.Environ(), Stdout: os.Stdout, Stderr: os.Stderr}
+}
+
+// Run runs a script of the package in dir, as part of the project in root. Like npm,
+// the .bin folder of every node_modules from dir up to root is put on the PATH, and
+// the npm_lifecycle_event and npm_package_* variables are set.
+func (r *ScriptRunner) Run(pkg *Package, dir, root, event, script string) error {
+	log.Infof("%s@%s %s: %s", pkg.Name, pkg.Version, event, script)
+	//scripts run in dir, so nothing can be relative to where fpm runs
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return err
+	}
+	root, err = filepath.Abs(root)
+	if err != nil {
+		return err
+	}
+	path := make([]string, 0, 4)
+	for d := dir; ; d = filepath.Dir(d) {
+		if filepath.Base(d) != "node_modules" {
+			path = append(path, filepath.Join(d, "node_modules", binDir))
+		}
+		if d == root || filepath.Dir(d) == d {
+			break
+		}
+	}
+
+	env := make([]string, 0, len(r.Env)+8)
+	for _, e := range r.Env {
+		switch {
+		case strings.HasPrefix(strings.ToUpper(e), "PATH="):
+			path = append(path, e[len("PATH="):])
+		case !strings.HasPrefix(e, "npm_"):
+			env = append(env, e)
+		}
+	}
+	env = append(env,
+		"PATH="+strings.Join(path, string(os.PathListSeparator)),
+		"INIT_CWD="+root,
+		"npm_lifecycle_event="+event,
+		"npm_lifecycle_script="+script,
+		"npm_package_name="+pkg.Name,
+		"npm_package_version="+pkg.Version,
+		"npm_package_json="+filepath.Join(dir, "package.json"),
+		"npm_config_user_agent=fpm",
+	)
+
+	args := append(append([]string(nil), r.Shell[1:]...), script)
+	cmd := exec.Command(r.Shell[0], args...)
+	cmd.Dir = dir
+	cmd.Env = env
+	cmd.Stdout = r.Stdout
+	cmd.Stderr = r.Stderr
+	return cmd.Run()
+}
+
+// RunScript runs a script from the scripts of the package in dir, as "npm run" does.
+// The arguments are quoted and appended to the script, but not to the pre and post
+// scripts around it, which run only when hooks is set.
+func (r *ScriptRunner) RunScript(pkg *Package, dir, name string, args []string, hooks bool) error {
+	script, ok := pkg.Scripts[name]
+	if !ok {
+		return errors.New("Missing script: " + name)
+	}
+	for _, arg := range args {
+		script += " " + quoteArg(arg)
+	}
+	scripts := [][2]string{{name, script}}
+	if hooks {
+		if pre := pkg.Scripts["pre"+name]; pre != "" {
+			scripts = append([][2]string{{"pre" + name, pre}}, scripts...)
+		}
+		if post := pkg.Scripts["post"+name]; post != "" {
+			scripts = append(scripts, [2]string{"post" + name, post})
+		}
+	}
+	for _, s := range scripts {
+		fmt.Fprintf(r.Stderr, "\n> %s@%s %s\n> %s\n\n", pkg.Name, pkg.Version, s[0], s[1])
+		err := r.Run(pkg, dir, dir, s[0], s[1])
+		if err != nil {
+			return &ScriptError{s[0], err}
+		}
+	}
+	return nil
+}
+
+// A ScriptError is returned by RunScript when a script fails
+type ScriptError struct {
+	Event string
+	Err   error
+}
+
+func (e *ScriptError) Error() string {
+	return e.Event + " script failed: " + e.Err.Error()
+}
+
+// ExitCode is the exit status of the script, or 1 if it couldn't be run or was killed
+func (e *ScriptError) ExitCode() int {
+	if ee, ok := e.Err.(*exec.ExitError); ok && ee.ExitCode() > 0 {
+		return ee.ExitCode()
+	}
+	return 1
+}
+
+// quoteArg quotes an argument for the shell scripts run with, unless it's safe as it is
+func quoteArg(arg string) string {
+	safe := "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789-_=+,.:/@"
+	if runtime.GOOS == "windows" {
+		if arg != "" && strings.Trim(arg, safe) == "" {
+			return arg
+		}
+		return quoteCmdArg(arg)
+	}
+	//% is only special to cmd.exe
+	if arg != "" && strings.Trim(arg, safe+"%") == "" {
+		return arg
+	}
+	return "'" + strings.Replace(arg, "'", `'\''`, -1) + "'"
+}
+
+// quoteCmdArg quotes an argument for cmd.exe, as npm does. It's quoted the way programs
+// split their command line, then every character cmd.exe treats specially, the quotes
+// included, is escaped with a ^ so it can't end the quoting early or expand %VARS%.
+func quoteCmdArg(arg string) string {
+	var buf bytes.Buffer
+	buf.WriteByte('"')
+	slashes := 0
+	for _, c := range arg {
+		switch c {
+		case '\\':
+			slashes++
+			continue
+		case '"':
+			//backslashes before a quote are escaped, along with the quote
+			buf.WriteString(strings.Repeat(`\`, 2*slashes+1))
+		default:
+			buf.WriteString(strings.Repeat(`\`, slashes))
+		}
+		slashes = 0
+		buf.WriteRune(c)
+	}
+	//and so are the ones before the closing quote
+	buf.WriteString(strings.Repeat(`\`, 2*slashes))
+	buf.WriteByte('"')
+
+	var out bytes.Buffer
+	for _, c := range buf.String() {
+		if strings.ContainsRune(` !%^&()<>|"`, c) {
+			out.WriteByte('^')
+		}
+		out.WriteRune(c)
+	}
+	return out.String()
+}
+
+// installScripts returns the install scripts a package has, in the order they run.
+// Packages with a binding.gyp and no install script of their own get built with node-gyp.
+func installScripts(pkg *Package, dir string, events []string) [][2]string {
+	scripts := make([][2]string, 0, len(events))
+	for _, event := range events {
+		script := pkg.Scripts[event]
+		if event == "install" && script == "" && pkg.Scripts["preinstall"] == "" {
+			if _, err := os.Stat(filepath.Join(dir, "binding.gyp")); err == nil {
+				script = "node-gyp rebuild"
+			}
+		}
+		if script != "" {
+			scripts = append(scripts, [2]string{event, script})
+		}
+	}
+	return scripts
+}
+
+// A scriptPackage is a package that was just installed, whose install scripts may need to run
+type scriptPackage struct {
+	Node *DependencyNode
+	Dir  string
+
+	//where it's recorded in the install state
+	Path string
+
+	//folders of the packages it depends on
+	Deps []string
+
+	//set once its install scripts started
+	Ran bool
+
+	//set once its install scripts succeeded, or it turned out to have none
+	Done bool
+
+	//why its install scripts didn't run, if they didn't
+	Skipped string
+}
+
+// trusts reports if the package at path can be taken to be the node, like
+// installState.trusts, unless its install scripts were skipped for a reason
+// that no longer holds, so that it's installed again to run them
+func (in *Installer) trusts(s *installState, path string, n *DependencyNode) bool {
+	if !s.trusts(path, n) {
+		return false
+	}
+	if s == nil {
+		return true
+	}
+	switch s.Packages[path].Skipped {
+	case scriptsIgnored:
+		return in.IgnoreScripts
+	case scriptsBlocked:
+		return in.IgnoreScripts || !in.ScriptPolicy.Allows(n.Name, n.Version)
+	}
+	return true
+}
+
+func (in *Installer) scripts() *ScriptRunner {
+	if in.Scripts != nil {
+		return in.Scripts
+	}
+	return NewScriptRunner()
+}
+
+// runScripts runs the install scripts of packages that were just installed. A package's
+// scripts wait for those of its dependencies, cycles aside, and up to Jobs run at once.
+// Output is kept back and only shown when a script fails, since it would be interleaved.
+// Packages the ScriptPolicy doesn't allow are skipped, and listed once everything ran.
+func (in *Installer) runScripts(pkgs []*scriptPackage) error {
+	if in.IgnoreScripts {
+		for _, p := range pkgs {
+			pkg, err := ReadPackage(p.Dir)
+			p.Done = err == nil && len(installScripts(pkg, p.Dir, installEvents)) == 0
+			if err == nil && !p.Done {
+				p.Skipped = scriptsIgnored
+			}
+		}
+		return nil
+	}
+	if len(pkgs) == 0 {
+		return nil
+	}
+	byDir := make(map[string]*scriptPackage, len(pkgs))
+	for _, p := range pkgs {
+		byDir[p.Dir] = p
+	}
+
+	//dependencies to wait for, leaving out the ones closing a cycle
+	waits := make(map[*scriptPackage][]*scriptPackage, len(pkgs))
+	state := make(map[*scriptPackage]int, len(pkgs))
+	var visit func(p *scriptPackage)
+	visit = func(p *scriptPackage) {
+		state[p] = 1
+		for _, dir := range p.Deps {
+			dep := byDir[dir]
+			if dep == nil || state[dep] == 1 {
+				continue
+			}
+			waits[p] = append(waits[p], dep)
+			if state[dep] == 0 {
+				visit(dep)
+			}
+		}
+		state[p] = 2
+	}
+	for _, p := range pkgs {
+		if state[p] == 0 {
+			visit(p)
+		}
+	}
+
+	done := make(map[*scriptPackage]chan struct{}, len(pkgs))
+	for _, p := range pkgs {
+		done[p] = make(chan struct{})
+	}
+	var mx sync.Mutex
+	var firstErr error
+	failed := make(map[*scriptPackage]bool, 10)
+	skipped := make([]string, 0, 10)
+	sem := make(chan struct{}, in.Jobs)
+	var wg sync.WaitGroup
+	for _, p := range pkgs {
+		wg.Add(1)
+		go func(p *scriptPackage) {
+			defer wg.Done()
+			defer close(done[p])
+			skip := false
+			for _, dep := range waits[p] {
+				<-done[dep]
+				mx.Lock()
+				skip = skip || failed[dep]
+				mx.Unlock()
+			}
+			err := errors.New("A dependency's install script failed")
+			if !skip {
+				var blocked bool
+				sem <- struct{}{}
+				blocked, err = in.runInstallScripts(p)
+				<-sem
+				if blocked {
+					mx.Lock()
+					skipped = append(skipped, p.Node.Name+"@"+p.Node.Version)
+					mx.Unlock()
+				}
+			}
+			if err == nil {
+				return
+			}
+			if p.Node.Optional {
+				log.Warnf("Install script of optional dependency %s@%s failed: %s", p.Node.Name, p.Node.Version, err.Error())
+				p.Skipped = scriptsFailed
+				return
+			}
+			mx.Lock()
+			failed[p] = true
+			if firstErr == nil {
+				firstErr = err
+			}
+			mx.Unlock()
+		}(p)
+	}
+	wg.Wait()
+	if len(skipped) > 0 {
+		sort.Strings(skipped)
+		log.Warnf("Skipped the install scripts of %d packages the script policy doesn't allow:\n  %s", len(skipped), strings.Join(skipped, "\n  "))
+	}
+	if in.ScriptPolicy == nil {
+		ran := make([]string, 0, 10)
+		for _, p := range pkgs {
+			if p.Ran {
+				ran = append(ran, p.Node.Name+"@"+p.Node.Version)
+			}
+		}
+		if len(ran) > 0 {
+			sort.Strings(ran)
+			log.Warnf("Ran the install scripts of %d packages without a script policy:\n  %s", len(ran), strings.Join(ran, "\n  "))
+		}
+	}
+	return firstErr
+}
+
+// runInstallScripts runs the install scripts of a single package, returning true
+// without running anything when it has some the ScriptPolicy doesn't allow.
+// The policy goes by the name and version the tree resolved, never by the package.json,
+// which is up to whoever published the package. Packages whose package.json claims to
+// be something else don't run scripts at all. Packages linked from the store get files
+// of their own first, since scripts may change them.
+func (in *Installer) runInstallScripts(p *scriptPackage) (bool, error) {
+	pkg, err := ReadPackage(p.Dir)
+	if err != nil {
+		return false, err
+	}
+	scripts := installScripts(pkg, p.Dir, installEvents)
+	if len(scripts) == 0 {
+		p.Done = true
+		return false, nil
+	}
+	if pkg.Name != p.Node.Name || pkg.Version != p.Node.Version {
+		log.Warnf("Skipped the install scripts of %s@%s, its package.json says it is %s@%s", p.Node.Name, p.Node.Version, pkg.Name, pkg.Version)
+		p.Skipped = scriptsMismatched
+		return false, nil
+	}
+	if !in.ScriptPolicy.Allows(p.Node.Name, p.Node.Version) {
+		p.Skipped = scriptsBlocked
+		return true, nil
+	}
+	if in.Store != nil {
+		err = detachPackage(p.Dir)
+		if err != nil {
+			return false, err
+		}
+	}
+	r := *in.scripts()
+	var out bytes.Buffer
+	r.Stdout, r.Stderr = &out, &out
+	p.Ran = true
+	for _, s := range scripts {
+		err = r.Run(pkg, p.Dir, in.Dir, s[0], s[1])
+		if err != nil {
+			return false, errors.New(pkg.Name + "@" + pkg.Version + " " + s[0] + " script failed: " + err.Error() + "\n" + out.String())
+		}
+		log.Debugf("%s@%s %s output:\n%s", pkg.Name, pkg.Version, s[0], out.String())
+		out.Reset()
+	}
+	p.Done = true
+	return false, nil
+}
+
+// settleScripts records the packages whose install scripts are done, or were skipped,
+// in the install state. The others stay pending, and are installed again by the next
+// install to run them.
+func settleScripts(modules string, pkgs []*scriptPackage) error {
+	if len(pkgs) == 0 {
+		return nil
+	}
+	state, err := readState(modules)
+	if err != nil || state == nil {
+		return err
+	}
+	for _, p := range pkgs {
+		if e, ok := state.Packages[p.Path]; ok && (p.Done || p.Skipped != "") {
+			e.Pending, e.Skipped = false, p.Skipped
+			state.Packages[p.Path] = e
+		}
+	}
+	return writeState(modules, state)
+}
+
+// RunProjectScripts runs the given lifecycle scripts of the project itself, which npm
+// runs on every install: projectPreEvents before the dependencies are installed and
+// projectEvents after. Nothing runs when IgnoreScripts is set.
+func (in *Installer) RunProjectScripts(pkg *Package, events []string) error {
+	if in.IgnoreScripts {
+		return nil
+	}
+	r := in.scripts()
+	for _, s := range installScripts(pkg, in.Dir, events) {
+		err := r.Run(pkg, in.Dir, in.Dir, s[0], s[1])
+		if err != nil {
+			return errors.New(s[0] + " script failed: " + err.Error())
+		}
+	}
+	return nil
+}
@@ -0,0 +1,356 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// TestScriptShell isn't a test, but the fake shell _testScriptRunner runs scripts with.
+// It appends the package, event and script to the file in FPM_TEST_SHELL, and exits
+// with the status given by scripts like "exit 1".
+func TestScriptShell(t *testing.T) {
+	path := os.Getenv("FPM_TEST_SHELL")
+	if path == "" {
+		return
+	}
+	script := os.Args[len(os.Args)-1]
+	fd, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		os.Exit(2)
+	}
+	bin := strings.Split(os.Getenv("PATH"), string(os.PathListSeparator))[0]
+	fmt.Fprintf(fd, "%s %s %s %s\n", os.Getenv("npm_package_name"), os.Getenv("npm_lifecycle_event"), script, filepath.Base(filepath.Dir(filepath.Dir(bin))))
+	fd.Close()
+	if strings.HasPrefix(script, "exit ") {
+		code, _ := strconv.Atoi(script[len("exit "):])
+		os.Exit(code)
+	}
+	os.Exit(0)
+}
+
+func _testScriptRunner(t *testing.T, log string) *ScriptRunner {
+	return &ScriptRunner{
+		Shell:  []string{os.Args[0], "-test.run=^TestScriptShell$", "--"},
+		Env:    append(os.Environ(), "FPM_TEST_SHELL="+log),
+		Stdout: ioutil.Discard,
+		Stderr: ioutil.Discard,
+	}
+}
+
+func TestInstaller_runScripts(t *testing.T) {
+	dir := _testDir(t, "fpm-scripts")
+	log := filepath.Join(dir, "log")
+	modules := filepath.Join(dir, "node_modules")
+	pkgs := map[string]string{
+		"a": `{"name":"a","scripts":{"postinstall":"a-post","preinstall":"a-pre","test":"no"}}`,
+		"b": `{"name":"b","scripts":{"install":"b-install"}}`,
+		"c": `{"name":"c","scripts":{"postinstall":"exit 1"}}`,
+		//installed as evil, but claiming to be c
+		"evil": `{"name":"c","scripts":{"postinstall":"evil"}}`,
+	}
+	for name, data := range pkgs {
+		os.MkdirAll(filepath.Join(modules, name), 0755)
+		err := ioutil.WriteFile(filepath.Join(modules, name, "package.json"), []byte(data), 0644)
+		if err != nil {
+			t.Fatalf("Failed to write package.json: %s\n", err.Error())
+		}
+	}
+	pkg := func(name string, optional bool, deps ...string) *scriptPackage {
+		p := &scriptPackage{Node: &DependencyNode{Name: name, Optional: optional}, Dir: filepath.Join(modules, name)}
+		for _, d := range deps {
+			p.Deps = append(p.Deps, filepath.Join(modules, d))
+		}
+		return p
+	}
+	read := func() string {
+		data, _ := ioutil.ReadFile(log)
+		os.Remove(log)
+		return string(data)
+	}
+
+	in := NewInstaller(dir, nil)
+	in.Scripts = _testScriptRunner(t, log)
+	//a and b depend on each other, the cycle is broken where it was found
+	err := in.runScripts([]*scriptPackage{pkg("a", false, "b"), pkg("b", false, "a")})
+	if err != nil {
+		t.Fatalf("Failed to run scripts: %s\n", err.Error())
+	}
+	expected := "b install b-install b\na preinstall a-pre a\na postinstall a-post a\n"
+	if out := read(); out != expected {
+		t.Errorf("Expected scripts to run bottom-up with their own .bin first:\n%s\nbut got:\n%s", expected, out)
+	}
+
+	err = in.runScripts([]*scriptPackage{pkg("a", false, "c"), pkg("c", false)})
+	if err == nil {
+		t.Errorf("Expected a failing script to fail the install")
+	}
+	if out := read(); out != "c postinstall exit 1 c\n" {
+		t.Errorf("Expected scripts depending on a failed one not to run, but got:\n%s", out)
+	}
+	err = in.runScripts([]*scriptPackage{pkg("c", true)})
+	if err != nil {
+		t.Errorf("Expected optional packages to be allowed to fail: %s", err.Error())
+	}
+	read()
+
+	err = in.runScripts([]*scriptPackage{pkg("evil", false)})
+	if err != nil || read() != "" {
+		t.Errorf("Expected a package claiming to be another not to run its scripts")
+	}
+
+	//a isn't in the policy, b only for other versions, and evil only looks like c
+	err = ioutil.WriteFile(filepath.Join(dir, ScriptPolicyName), []byte("b@^2.0.0\n# any c\nc\n"), 0644)
+	if err != nil {
+		t.Fatalf("Failed to write policy: %s\n", err.Error())
+	}
+	in.ScriptPolicy, err = ReadScriptPolicy(filepath.Join(dir, ScriptPolicyName))
+	if err != nil {
+		t.Fatalf("Failed to read policy: %s\n", err.Error())
+	}
+	err = in.runScripts([]*scriptPackage{pkg("a", false), pkg("b", false), pkg("c", true), pkg("evil", false)})
+	if err != nil {
+		t.Fatalf("Failed to run scripts: %s\n", err.Error())
+	}
+	if out := read(); out != "c postinstall exit 1 c\n" {
+		t.Errorf("Expected only the scripts of allowed packages to run, but got:\n%s", out)
+	}
+	in.ScriptPolicy = nil
+
+	in.IgnoreScripts = true
+	err = in.runScripts([]*scriptPackage{pkg("a", false), pkg("b", false)})
+	if err != nil || read() != "" {
+		t.Errorf("Expected no scripts to run with IgnoreScripts")
+	}
+}
+
+func TestInstaller_runScriptsStore(t *testing.T) {
+	dir := _testDir(t, "fpm-scripts")
+	store := NewStore(filepath.Join(dir, "store"))
+	add := func(data string) storeFile {
+		f, err := store.addFile(strings.NewReader(data), 0644)
+		if err != nil {
+			t.Fatalf("Failed to add file to store: %s\n", err.Error())
+		}
+		return f
+	}
+	index := add("module.exports = 'a'\n")
+	a := filepath.Join(dir, "node_modules", "a")
+	err := store.link(&storeIndex{Files: map[string]storeFile{
+		"package.json":                add(`{"name":"a","scripts":{"install":"build"}}`),
+		"index.js":                    index,
+		"node_modules/b/package.json": add(`{"name":"b"}`),
+		"node_modules/b/index.js":     index,
+	}}, a)
+	if err != nil {
+		t.Fatalf("Failed to link from store: %s\n", err.Error())
+	}
+
+	in := NewInstaller(dir, nil)
+	in.Store = store
+	in.Scripts = _testScriptRunner(t, filepath.Join(dir, "log"))
+	err = in.runScripts([]*scriptPackage{{Node: &DependencyNode{Name: "a"}, Dir: a}})
+	if err != nil {
+		t.Fatalf("Failed to run scripts: %s\n", err.Error())
+	}
+	stored, err := os.Stat(store.filePath(index.Hash))
+	if err != nil {
+		t.Fatalf("Failed to stat store file: %s\n", err.Error())
+	}
+	for path, linked := range map[string]bool{"index.js": false, "node_modules/b/index.js": true} {
+		info, err := os.Stat(filepath.Join(a, filepath.FromSlash(path)))
+		if err != nil {
+			t.Errorf("Failed to stat %s: %s", path, err.Error())
+			continue
+		}
+		if os.SameFile(info, stored) != linked {
+			t.Errorf("Expected %s to be linked from the store to be %t", path, linked)
+		}
+	}
+	data, err := ioutil.ReadFile(filepath.Join(a, "index.js"))
+	if err != nil || string(data) != "module.exports = 'a'\n" {
+		t.Errorf("Expected the copy to keep the contents of the stored file")
+	}
+}
+
+func TestInstaller_pendingScripts(t *testing.T) {
+	r, srv := _testRegistry(t, testPackages{
+		"a@1.0.0": {".postinstall": "exit 1"},
+		"b@1.0.0": {".postinstall": "build"},
+		"c@1.0.0": nil,
+	})
+	defer srv.Close()
+	dir := _testDir(t, "fpm-pending")
+	log := filepath.Join(dir, "log")
+	tree, err := CalculateTree(r, &Package{Dependencies: _deps(t, map[string]string{"a": "^1", "b": "^1", "c": "^1"})}, ResolveOptions{})
+	if err != nil {
+		t.Fatalf("Failed to calculate tree: %s\n", err.Error())
+	}
+	if !tree.Nodes["a"].HasInstallScript || tree.Nodes["c"].HasInstallScript {
+		t.Errorf("Expected only packages with install scripts to be flagged")
+	}
+
+	in := NewInstaller(dir, NewCache(filepath.Join(dir, "cache")))
+	in.Scripts = _testScriptRunner(t, log)
+	in.ScriptPolicy = &ScriptPolicy{[]scriptRule{{name: "a"}, {name: "c"}}}
+	_, _, err = in.Update(tree)
+	if err == nil {
+		t.Errorf("Expected the failing script of a to fail the install")
+	}
+	state, err := readState(filepath.Join(dir, "node_modules"))
+	if err != nil || state == nil {
+		t.Fatalf("Failed to read state: %v\n", err)
+	}
+	check := func(expected map[string]installedState) {
+		state, err := readState(filepath.Join(dir, "node_modules"))
+		if err != nil || state == nil {
+			t.Fatalf("Failed to read state: %v\n", err)
+		}
+		for path, e := range expected {
+			if state.Packages[path].Pending != e.Pending || state.Packages[path].Skipped != e.Skipped {
+				t.Errorf("Expected %s to be pending %t and skipped '%s' but got %v", path, e.Pending, e.Skipped, state.Packages[path])
+			}
+		}
+	}
+	check(map[string]installedState{"a": {Pending: true}, "b": {Skipped: scriptsBlocked}, "c": {}})
+
+	//only the failed script gets another chance while the policy stays the same
+	changed, _, err := in.Update(tree)
+	if err == nil {
+		t.Errorf("Expected the failing script of a to fail the install again")
+	}
+	if changed != 1 {
+		t.Errorf("Expected only a to be installed again but got %d changed", changed)
+	}
+
+	//and the blocked one once it's allowed
+	os.Remove(log)
+	in.ScriptPolicy = nil
+	changed, _, err = in.Update(tree)
+	if err == nil {
+		t.Errorf("Expected the failing script of a to fail the install again")
+	}
+	if changed != 2 {
+		t.Errorf("Expected a and b to be installed again but got %d changed", changed)
+	}
+	data, _ := ioutil.ReadFile(log)
+	if !strings.Contains(string(data), "b postinstall build b\n") {
+		t.Errorf("Expected the script of b to run once allowed, but got:\n%s", string(data))
+	}
+	check(map[string]installedState{"a": {Pending: true}, "b": {}, "c": {}})
+
+	//ignored scripts settle too, until scripts aren't ignored anymore
+	in.IgnoreScripts = true
+	_, _, err = in.Update(tree)
+	if err != nil {
+		t.Fatalf("Failed to update: %s\n", err.Error())
+	}
+	check(map[string]installedState{"a": {Skipped: scriptsIgnored}, "b": {}, "c": {}})
+	changed, _, err = in.Update(tree)
+	if err != nil || changed != 0 {
+		t.Errorf("Expected nothing to change while scripts are ignored but got %d changed: %v", changed, err)
+	}
+	in.IgnoreScripts = false
+	changed, _, _ = in.Update(tree)
+	if changed != 1 {
+		t.Errorf("Expected a to be installed again to run its script but got %d changed", changed)
+	}
+}
+
+func TestInstaller_RunProjectScripts(t *testing.T) {
+	dir := _testDir(t, "fpm-project-scripts")
+	log := filepath.Join(dir, "log")
+	in := NewInstaller(dir, nil)
+	in.Scripts = _testScriptRunner(t, log)
+	pkg := &Package{Name: "p", Scripts: map[string]string{
+		"preinstall":  "p-pre",
+		"postinstall": "p-post",
+		"prepare":     "p-prepare",
+		"test":        "no",
+	}}
+	read := func() string {
+		data, _ := ioutil.ReadFile(log)
+		os.Remove(log)
+		return string(data)
+	}
+
+	base := filepath.Base(dir)
+
+	//preinstall comes before the dependencies, the rest after them
+	err := in.RunProjectScripts(pkg, projectPreEvents)
+	if err != nil {
+		t.Fatalf("Failed to run project scripts: %s\n", err.Error())
+	}
+	if out, expected := read(), "p preinstall p-pre "+base+"\n"; out != expected {
+		t.Errorf("Expected only the preinstall script to run first:\n%s\nbut got:\n%s", expected, out)
+	}
+	err = in.RunProjectScripts(pkg, projectEvents)
+	if err != nil {
+		t.Fatalf("Failed to run project scripts: %s\n", err.Error())
+	}
+	if out, expected := read(), "p postinstall p-post "+base+"\np prepare p-prepare "+base+"\n"; out != expected {
+		t.Errorf("Expected the other install and prepare scripts to run after:\n%s\nbut got:\n%s", expected, out)
+	}
+}
+
+func TestScriptRunner_RunScript(t *testing.T) {
+	dir := _testDir(t, "fpm-run")
+	log := filepath.Join(dir, "log")
+	pkg := &Package{Name: "app", Scripts: map[string]string{"prebuild": "gen", "build": "tsc", "postbuild": "exit 3", "test": "jest"}}
+	read := func() string {
+		data, _ := ioutil.ReadFile(log)
+		os.Remove(log)
+		return string(data)
+	}
+	r := _testScriptRunner(t, log)
+	base := filepath.Base(dir)
+
+	err := r.RunScript(pkg, dir, "test", []string{"--watch", "it's a test"}, true)
+	if err != nil {
+		t.Fatalf("Failed to run script: %s\n", err.Error())
+	}
+	expected := "app test jest --watch 'it'\\''s a test' " + base + "\n"
+	if out := read(); out != expected {
+		t.Errorf("Expected the arguments to be quoted and passed along:\n%s\nbut got:\n%s", expected, out)
+	}
+
+	err = r.RunScript(pkg, dir, "build", []string{"x"}, true)
+	if se, ok := err.(*ScriptError); !ok || se.Event != "postbuild" || se.ExitCode() != 3 {
+		t.Errorf("Expected a failing post script to fail with its exit status, but got: %v", err)
+	}
+	expected = "app prebuild gen " + base + "\napp build tsc x " + base + "\napp postbuild exit 3 " + base + "\n"
+	if out := read(); out != expected {
+		t.Errorf("Expected the pre and post scripts around the script:\n%s\nbut got:\n%s", expected, out)
+	}
+	err = r.RunScript(pkg, dir, "build", nil, false)
+	if err != nil || read() != "app build tsc "+base+"\n" {
+		t.Errorf("Expected only the script itself to run without hooks")
+	}
+
+	err = r.RunScript(pkg, dir, "lint", nil, true)
+	if err == nil {
+		t.Errorf("Expected a missing script to fail")
+	}
+}
+
+func TestQuoteCmdArg(t *testing.T) {
+	tests := map[string]string{
+		`a b`:         `^"a^ b^"`,
+		`say "hi"`:    `^"say^ \^"hi\^"^"`,
+		`100%`:        `^"100^%^"`,
+		`%PATH%`:      `^"^%PATH^%^"`,
+		`a&b|c`:       `^"a^&b^|c^"`,
+		`C:\dir\`:     `^"C:\dir\\^"`,
+		`back\"slash`: `^"back\\\^"slash^"`,
+		``:            `^"^"`,
+	}
+	for arg, expected := range tests {
+		if quoted := quoteCmdArg(arg); quoted != expected {
+			t.Errorf("Expected %s to be quoted as %s but got %s", arg, expected, quoted)
+		}
+	}
+}
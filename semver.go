@@ -23,6 +23,7 @@ type requirement struct {
 
 type SemverRequirements struct {
 	requirements [][]requirement
+	source       string
 }
 
 var cleanup = strings.NewReplacer("  ", " ", "> ", ">", "= ", "=", "< ", "<")
@@ -152,9 +153,15 @@ func (s *SemverRequirements) String() string {
 	return strings.Join(ors, " || ")
 }
 
+// Range returns the requirements string as it was originally written
+func (s *SemverRequirements) Range() string {
+	return s.source
+}
+
 // NewSemverRequirements parses a requirements string using the format defined here: https://github.com/npm/node-semver
 func NewSemverRequirements(requirements string) (*SemverRequirements, error) {
 	sr := new(SemverRequirements)
+	sr.source = requirements
 
 	//cleanup, trim and remove duplicate whitespace
 	requirements = cleanup.Replace(strings.TrimSpace(requirements))
@@ -0,0 +1,564 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/blang/semver"
+)
+
+// solverMaxSteps bounds how many versions the solver will try before giving up
+const solverMaxSteps = 20000
+
+// A solver picks a single version of every package so that all requirements on it are met,
+// backtracking when an earlier pick rules out a later one. When a pick turns out not to be
+// involved in a conflict, the search jumps straight back past it to a pick that is.
+// Optional dependencies no version works for are left out instead of failing the solve.
+type solver struct {
+	ResolveOptions
+	r           *Registry
+	steps       int
+	decided     map[string]semver.Version
+	packages    map[string]*Package
+	constraints map[string][]solverConstraint
+
+	//since the tree is flat, only top-level rules and the ones
+	//nested directly under the package being picked can apply
+	overrides []*overrideRule
+
+	locked map[string][]semver.Version
+}
+
+type solverConstraint struct {
+	req *SemverRequirements
+	//"name@version" of the package imposing it, empty for the root
+	source string
+	//only applies if something else brings in the package, like an optional peer
+	ifPresent bool
+	//comes from a dev, optional or peer dependency, or one of those further up
+	dev      bool
+	optional bool
+	peer     bool
+	//an override rule replaced the range asked for
+	overridden bool
+	//an optional dependency itself, left out rather than failing the solve when it conflicts
+	optionalDep bool
+	dropped     bool
+}
+
+// a solverConflict explains why the current picks can't lead to a solution
+type solverConflict struct {
+	//picks ("name@version") that the conflict depends on
+	causes   map[string]bool
+	reason   string
+	versions []solverFailure
+	gaveUp   bool
+}
+
+type solverFailure struct {
+	version string
+	c       *solverConflict
+}
+
+// A SolverError is returned when no set of versions satisfies every requirement
+type SolverError struct {
+	c *solverConflict
+}
+
+func (e *SolverError) Error() string {
+	var buf bytes.Buffer
+	if e.c.gaveUp {
+		fmt.Fprintf(&buf, "Version solving gave up after trying %d versions", solverMaxSteps)
+		return buf.String()
+	}
+	buf.WriteString("Version solving failed because:\n")
+	e.c.write(&buf, "  ")
+	return strings.TrimRight(buf.String(), "\n")
+}
+
+func (c *solverConflict) write(buf *bytes.Buffer, indent string) {
+	buf.WriteString(indent + c.reason + "\n")
+
+	//versions failing for the same reason are listed together
+	groups := make([]string, 0, len(c.versions))
+	versions := make(map[string][]string, len(c.versions))
+	for _, f := range c.versions {
+		var sub bytes.Buffer
+		f.c.write(&sub, indent+"    ")
+		key := sub.String()
+		if versions[key] == nil {
+			groups = append(groups, key)
+		}
+		versions[key] = append(versions[key], f.version)
+	}
+	for _, key := range groups {
+		buf.WriteString(indent + "  " + strings.Join(versions[key], ", ") + ":\n")
+		buf.WriteString(key)
+	}
+}
+
+func sourceName(source string) string {
+	if source == "" {
+		return "root"
+	}
+	return source
+}
+
+func (s *solver) addConstraint(name string, c solverConstraint) {
+	s.constraints[name] = append(s.constraints[name], c)
+	s.r.prefetch(name)
+}
+
+// describe lists the constraints on a package, e.g. "^1.0.0 (from a@1.0.0) and ^2 (from root)"
+func (s *solver) describe(name string) string {
+	parts := make([]string, 0, len(s.constraints[name]))
+	for _, c := range s.constraints[name] {
+		if !c.dropped {
+			parts = append(parts, c.req.Range()+" (from "+sourceName(c.source)+")")
+		}
+	}
+	return strings.Join(parts, " and ")
+}
+
+// sources returns the picks responsible for the constraints on a package
+func (s *solver) sources(name string) map[string]bool {
+	m := make(map[string]bool, len(s.constraints[name]))
+	for _, c := range s.constraints[name] {
+		if c.source != "" && !c.dropped {
+			m[c.source] = true
+		}
+	}
+	return m
+}
+
+func (s *solver) candidates(name string) ([]semver.Version, error) {
+	result, _, err := s.matching(name)
+	return result, err
+}
+
+// matching returns the versions satisfying every constraint on a package,
+// split into the usable ones and the ones held back by MinReleaseAge
+func (s *solver) matching(name string) (result []semver.Version, skipped []string, err error) {
+	versions, err := s.r.PackageVersions(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	result = make([]semver.Version, 0, len(versions))
+outer:
+	for _, v := range versions {
+		for _, c := range s.constraints[name] {
+			if !c.dropped && !c.req.SatisfiedBy(v) {
+				continue outer
+			}
+		}
+		if s.r.quarantined(name, v) {
+			skipped = append(skipped, v.String())
+			continue
+		}
+		result = append(result, v)
+	}
+	return result, skipped, nil
+}
+
+// next picks the undecided package with the fewest candidates left, so conflicts show up early
+func (s *solver) next() (string, []semver.Version, error) {
+	names := make([]string, 0, len(s.constraints))
+	for name, cs := range s.constraints {
+		if _, ok := s.decided[name]; ok {
+			continue
+		}
+		for _, c := range cs {
+			if !c.ifPresent && !c.dropped {
+				names = append(names, name)
+				break
+			}
+		}
+	}
+	sort.Strings(names)
+
+	best := ""
+	var bestCands []semver.Version
+	for _, name := range names {
+		cands, err := s.candidates(name)
+		if err != nil {
+			return name, nil, err
+		}
+		if best == "" || len(cands) < len(bestCands) {
+			best, bestCands = name, cands
+		}
+		if len(cands) == 0 {
+			break
+		}
+	}
+	return best, bestCands, nil
+}
+
+func (s *solver) solve() *solverConflict {
+	name, cands, err := s.next()
+	if err != nil {
+		return &solverConflict{causes: s.sources(name), reason: "unable to get " + name + ": " + err.Error()}
+	}
+	if name == "" {
+		return nil
+	}
+	if len(cands) == 0 {
+		reason := "no version of " + name + " matches " + s.describe(name)
+		if _, skipped, _ := s.matching(name); len(skipped) > 0 {
+			reason += ", held back: " + strings.Join(skipped, ", ")
+		}
+		return s.dropOptional(name, &solverConflict{causes: s.sources(name), reason: reason})
+	}
+
+	conflict := &solverConflict{
+		causes: s.sources(name),
+		reason: "no version of " + name + " matching " + s.describe(name) + " works:",
+	}
+	if s.PreferLowest {
+		for i, j := 0, len(cands)-1; i < j; i, j = i+1, j-1 {
+			cands[i], cands[j] = cands[j], cands[i]
+		}
+	}
+	if s.PreferNonDeprecated {
+		sort.SliceStable(cands, func(i, j int) bool {
+			return !s.deprecated(name, cands[i]) && s.deprecated(name, cands[j])
+		})
+	}
+	if len(s.locked[name]) > 0 {
+		locked := make(map[string]bool, len(s.locked[name]))
+		for _, v := range s.locked[name] {
+			locked[v.String()] = true
+		}
+		sort.SliceStable(cands, func(i, j int) bool {
+			return locked[cands[i].String()] && !locked[cands[j].String()]
+		})
+	}
+	for _, v := range cands {
+		s.steps++
+		if s.steps > solverMaxSteps {
+			return &solverConflict{gaveUp: true}
+		}
+		key := name + "@" + v.String()
+		c := s.try(name, v)
+		if c == nil {
+			//the constraints are still in place, so these are the versions this pick passed over
+			_, skipped, _ := s.matching(name)
+			s.r.warnHeldBack(name, v, skipped)
+			return nil
+		}
+		//nothing this pick did caused the conflict, so trying another version of it won't help
+		if c.gaveUp || !c.causes[key] {
+			return c
+		}
+		for k := range c.causes {
+			if k != key {
+				conflict.causes[k] = true
+			}
+		}
+		conflict.versions = append(conflict.versions, solverFailure{key, c})
+	}
+	return s.dropOptional(name, conflict)
+}
+
+// dropOptional carries on solving without the optional dependencies on a package
+// no version works for, leaving them out like ones that aren't available
+func (s *solver) dropOptional(name string, conflict *solverConflict) *solverConflict {
+	dropped := make([]int, 0, 2)
+	for i, c := range s.constraints[name] {
+		if c.optionalDep && !c.dropped {
+			s.constraints[name][i].dropped = true
+			dropped = append(dropped, i)
+		}
+	}
+	if len(dropped) == 0 {
+		return conflict
+	}
+	c := s.solve()
+	if c == nil {
+		return nil
+	}
+	for _, i := range dropped {
+		s.constraints[name][i].dropped = false
+	}
+	if c.gaveUp {
+		return c
+	}
+	return conflict
+}
+
+// available checks that an optional dependency has a version to pick
+func (s *solver) available(name string, req *SemverRequirements) error {
+	versions, err := s.r.CompatablePackageVersions(name, req)
+	if err != nil {
+		return err
+	}
+	if len(versions) == 0 {
+		return errors.New("No compatable versions available for: " + name + "@" + req.String())
+	}
+	return nil
+}
+
+// wantedBy reports if a package is only wanted by dev, optional or peer dependencies
+func (s *solver) wantedBy(name string) (dev, optional, peer bool) {
+	dev, optional, peer = true, true, true
+	for _, c := range s.constraints[name] {
+		if !c.dropped {
+			dev, optional, peer = dev && c.dev, optional && c.optional, peer && c.peer
+		}
+	}
+	return dev, optional, peer
+}
+
+func (s *solver) deprecated(name string, v semver.Version) bool {
+	pkg, err := s.r.PackageByVersion(name, v.String())
+	return err == nil && pkg.Deprecated != ""
+}
+
+// try picks a version of a package, adds the requirements it brings and carries on solving,
+// undoing it all if that doesn't lead to a solution
+func (s *solver) try(name string, v semver.Version) *solverConflict {
+	key := name + "@" + v.String()
+	//everything under an optional package is optional too, and the same goes for dev and peer
+	dev, optional, peer := s.wantedBy(name)
+	pkg, err := s.r.PackageByVersion(name, v.String())
+	if err == nil && !optional {
+		err = s.Target.checkPlatform(key, pkg.PlatformSupport)
+	}
+	if err == nil && s.EngineStrict {
+		err = s.Target.checkEngines(pkg)
+	}
+	if err != nil {
+		return &solverConflict{causes: map[string]bool{key: true}, reason: err.Error()}
+	}
+
+	added := make([]string, 0, len(pkg.Dependencies)+len(pkg.PeerDependencies))
+	undo := func() {
+		for _, dep := range added {
+			s.constraints[dep] = s.constraints[dep][:len(s.constraints[dep])-1]
+		}
+	}
+	top := &overrideContext{s.overrides, nil}
+	exact, err := NewSemverRequirements(v.String())
+	if err != nil {
+		return &solverConflict{causes: map[string]bool{key: true}, reason: err.Error()}
+	}
+	ctx := top.enter(top.lookup(s.r, name, exact))
+	add := func(dep string, req *SemverRequirements, kind int, ifPresent bool) *solverConflict {
+		optionalDep := kind == depOptional
+		overridden := false
+		if rule := ctx.lookup(s.r, dep, req); rule != nil && rule.value != nil && rule.value.Range() != req.Range() {
+			log.Debugf("Overriding %s@%s with %s for %s", dep, req.Range(), rule.value.Range(), key)
+			req = rule.value
+			overridden = true
+		}
+		c := solverConstraint{
+			req:         req,
+			source:      key,
+			ifPresent:   ifPresent,
+			dev:         dev,
+			optional:    optional || optionalDep,
+			peer:        peer || kind == depPeer,
+			overridden:  overridden,
+			optionalDep: optionalDep,
+		}
+		if picked, ok := s.decided[dep]; ok && !req.SatisfiedBy(picked) {
+			if optionalDep {
+				c.dropped = true
+				s.constraints[dep] = append(s.constraints[dep], c)
+				added = append(added, dep)
+				return nil
+			}
+			return &solverConflict{
+				causes: map[string]bool{key: true, dep + "@" + picked.String(): true},
+				reason: key + " depends on " + dep + "@" + req.Range() + " but " + dep + "@" + picked.String() + " was picked",
+			}
+		}
+		s.addConstraint(dep, c)
+		added = append(added, dep)
+		return nil
+	}
+
+	for _, dep := range sortedReqKeys(pkg.Dependencies) {
+		if pkg.OptionalDependencies[dep] != nil {
+			continue
+		}
+		if c := add(dep, pkg.Dependencies[dep], depProd, false); c != nil {
+			undo()
+			return c
+		}
+	}
+	for _, dep := range sortedReqKeys(pkg.OptionalDependencies) {
+		if err := s.available(dep, pkg.OptionalDependencies[dep]); err != nil {
+			skipLog(err)("Skipping optional dependency %s of %s: %s", dep, key, err.Error())
+			continue
+		}
+		if c := add(dep, pkg.OptionalDependencies[dep], depOptional, false); c != nil {
+			undo()
+			return c
+		}
+	}
+	for _, dep := range sortedReqKeys(pkg.PeerDependencies) {
+		if s.LegacyPeerDeps || pkg.Dependencies[dep] != nil || pkg.OptionalDependencies[dep] != nil {
+			continue
+		}
+		if c := add(dep, pkg.PeerDependencies[dep], depPeer, pkg.PeerDependenciesMeta[dep].Optional); c != nil {
+			undo()
+			return c
+		}
+	}
+
+	s.decided[name] = v
+	s.packages[name] = pkg
+	//picks can still be undone, but most stick and are worth fetching right away
+	if s.Settled != nil {
+		n := s.node(name, v, pkg)
+		n.Dev, n.Optional, n.Peer = dev, optional, peer
+		s.Settled(n)
+	}
+	c := s.solve()
+	if c != nil {
+		delete(s.decided, name)
+		delete(s.packages, name)
+		undo()
+	}
+	return c
+}
+
+func sortedSolverKeys(m map[string][]solverConstraint) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// node makes the node for a picked version of a package
+func (s *solver) node(name string, v semver.Version, pkg *Package) *DependencyNode {
+	node := &DependencyNode{
+		Name:             name,
+		Version:          v.String(),
+		Tarball:          pkg.Dist.Tarball,
+		Shasum:           pkg.Dist.Shasum,
+		Integrity:        pkg.Dist.Integrity,
+		Requires:         make(map[string]string, len(pkg.Dependencies)),
+		OptionalRequires: make(map[string]string, len(pkg.OptionalDependencies)),
+		PeerRequires:     make(map[string]string, len(pkg.PeerDependencies)),
+		Nodes:            map[string]*DependencyNode{},
+		HasInstallScript: pkg.hasInstallScript(),
+		Deprecated:       pkg.Deprecated,
+		PlatformSupport:  pkg.PlatformSupport,
+	}
+	for dep, req := range pkg.Dependencies {
+		if pkg.OptionalDependencies[dep] == nil {
+			node.Requires[dep] = req.Range()
+		}
+	}
+	for dep, req := range pkg.OptionalDependencies {
+		node.OptionalRequires[dep] = req.Range()
+	}
+	for dep, req := range pkg.PeerDependencies {
+		if !s.LegacyPeerDeps && pkg.Dependencies[dep] == nil && pkg.OptionalDependencies[dep] == nil {
+			node.PeerRequires[dep] = req.Range()
+		}
+	}
+	return node
+}
+
+// solveTree resolves the root package with the solver, giving a flat tree
+// with every package at the top of node_modules
+func solveTree(r *Registry, root *Package, opts ResolveOptions) (*DependencyTree, error) {
+	s := &solver{
+		ResolveOptions: opts,
+		r:              r,
+		decided:        make(map[string]semver.Version, 100),
+		packages:       make(map[string]*Package, 100),
+		constraints:    make(map[string][]solverConstraint, 100),
+		locked:         lockedVersions(opts.Locked),
+	}
+	rules, err := parseOverrides(root)
+	if err != nil {
+		return nil, err
+	}
+	s.overrides = rules
+	t := new(DependencyTree)
+	t.Nodes = make(map[string]*DependencyNode, 100)
+	t.Requires = make(map[string]string, len(root.Dependencies))
+	t.DevRequires = make(map[string]string, len(root.DevDependencies))
+	t.OptionalRequires = make(map[string]string, len(root.OptionalDependencies))
+
+	for _, name := range sortedReqKeys(root.Dependencies) {
+		if root.OptionalDependencies[name] == nil {
+			t.Requires[name] = root.Dependencies[name].Range()
+			s.addConstraint(name, solverConstraint{req: root.Dependencies[name]})
+		}
+	}
+	for _, name := range sortedReqKeys(root.DevDependencies) {
+		if root.Dependencies[name] == nil && root.OptionalDependencies[name] == nil {
+			t.DevRequires[name] = root.DevDependencies[name].Range()
+			s.addConstraint(name, solverConstraint{req: root.DevDependencies[name], dev: true})
+		}
+	}
+	for _, name := range sortedReqKeys(root.OptionalDependencies) {
+		if err := s.available(name, root.OptionalDependencies[name]); err != nil {
+			skipLog(err)("Skipping optional dependency %s: %s", name, err.Error())
+			continue
+		}
+		t.OptionalRequires[name] = root.OptionalDependencies[name].Range()
+		s.addConstraint(name, solverConstraint{req: root.OptionalDependencies[name], optional: true, optionalDep: true})
+	}
+
+	c := s.solve()
+	if c != nil {
+		return nil, &SolverError{c}
+	}
+	log.Debugf("Solved %d packages in %d steps", len(s.decided), s.steps)
+	for _, name := range sortedSolverKeys(s.constraints) {
+		for _, c := range s.constraints[name] {
+			if !c.dropped {
+				continue
+			}
+			log.Warnf("Skipping optional dependency %s@%s of %s: it conflicts with the other requirements on it", name, c.req.Range(), sourceName(c.source))
+			if c.source == "" {
+				delete(t.OptionalRequires, name)
+			}
+		}
+	}
+
+	names := make([]string, 0, len(s.decided))
+	for name := range s.decided {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		pkg := s.packages[name]
+		//platforms were checked while picking, this warns about engines, or fails with EngineStrict
+		err = s.checkTarget(pkg, true)
+		if err != nil {
+			return nil, err
+		}
+		t.Nodes[name] = s.node(name, s.decided[name], pkg)
+	}
+	//like the resolver, the overridden ranges are what a package is recorded to require
+	for name, cs := range s.constraints {
+		for _, c := range cs {
+			if !c.overridden || c.dropped || t.Nodes[name] == nil {
+				continue
+			}
+			t.Nodes[name].Overridden = true
+			from := t.Nodes[c.source[:strings.LastIndex(c.source, "@")]]
+			for _, reqs := range []map[string]string{from.Requires, from.OptionalRequires, from.PeerRequires} {
+				if _, ok := reqs[name]; ok {
+					reqs[name] = c.req.Range()
+				}
+			}
+		}
+	}
+	t.prune()
+	t.markFlags()
+	t.warnDeprecated()
+	return t, nil
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSolveTree_backtrack(t *testing.T) {
+	r, srv := _testRegistry(t, testPackages{
+		"a@1.0.0": {"c": "^1.0.0"},
+		"a@1.1.0": {"c": "^2.0.0"},
+		"b@1.0.0": {"c": "^1.0.0"},
+		"c@1.0.0": nil,
+		"c@2.0.0": nil,
+	})
+	defer srv.Close()
+
+	tree, err := CalculateTree(r, &Package{Dependencies: _deps(t, map[string]string{"a": "^1", "b": "^1"})}, ResolveOptions{Solver: true})
+	if err != nil {
+		t.Fatalf("Failed to solve: %s\n", err.Error())
+	}
+	_treeCheck(t, tree, map[string]string{
+		"a": "1.0.0",
+		"b": "1.0.0",
+		"c": "1.0.0",
+	})
+}
+
+func TestSolveTree_peers(t *testing.T) {
+	r, srv := _testRegistry(t, testPackages{
+		"plugin@1.1.0": {},
+		"host@1.0.0":   nil,
+		"host@2.0.0":   nil,
+	})
+	defer srv.Close()
+	pkg, err := r.PackageByVersion("plugin", "1.1.0")
+	if err != nil {
+		t.Fatalf("Failed to get package: %s\n", err.Error())
+	}
+	pkg.PeerDependencies = _deps(t, map[string]string{"host": "^1.0.0"})
+
+	root := &Package{Dependencies: _deps(t, map[string]string{"plugin": "^1", "host": "^1 || ^2"})}
+	_, err = CalculateTree(r, root, ResolveOptions{})
+	if _, ok := err.(*PeerConflictError); !ok {
+		t.Errorf("Expected greedy resolution to hit a peer conflict but got: %v", err)
+	}
+
+	tree, err := CalculateTree(r, root, ResolveOptions{Solver: true})
+	if err != nil {
+		t.Fatalf("Failed to solve: %s\n", err.Error())
+	}
+	_treeCheck(t, tree, map[string]string{
+		"plugin": "1.1.0",
+		"host":   "1.0.0",
+	})
+}
+
+func TestSolveTree_optionalConflict(t *testing.T) {
+	r, srv := _testRegistry(t, testPackages{
+		"a@1.0.0": {},
+		"b@1.0.0": {"c": "^2.0.0"},
+		"c@1.0.0": nil,
+		"c@2.0.0": nil,
+	})
+	defer srv.Close()
+	pkg, err := r.PackageByVersion("a", "1.0.0")
+	if err != nil {
+		t.Fatalf("Failed to get package: %s\n", err.Error())
+	}
+	pkg.OptionalDependencies = _deps(t, map[string]string{"c": "^1.0.0"})
+
+	//the optional dependency of a is left out rather than failing
+	for _, root := range []*Package{
+		{Dependencies: _deps(t, map[string]string{"a": "^1", "b": "^1"})},
+		{Dependencies: _deps(t, map[string]string{"a": "^1", "c": "^2"})},
+	} {
+		tree, err := CalculateTree(r, root, ResolveOptions{Solver: true})
+		if err != nil {
+			t.Fatalf("Failed to solve: %s\n", err.Error())
+		}
+		if tree.Nodes["a"] == nil || tree.Nodes["c"] == nil || tree.Nodes["c"].Version != "2.0.0" {
+			t.Errorf("Expected a and c@2.0.0 to be picked")
+		}
+	}
+
+	tree, err := CalculateTree(r, &Package{
+		Dependencies:         _deps(t, map[string]string{"b": "^1"}),
+		OptionalDependencies: _deps(t, map[string]string{"c": "^1"}),
+	}, ResolveOptions{Solver: true})
+	if err != nil {
+		t.Fatalf("Expected an optional dependency of the root to be left out too, but got: %s\n", err.Error())
+	}
+	if tree.Nodes["c"] == nil || tree.Nodes["c"].Version != "2.0.0" || tree.OptionalRequires["c"] != "" {
+		t.Errorf("Expected c@2.0.0 to be picked for b alone")
+	}
+}
+
+func TestSolveTree_failure(t *testing.T) {
+	r, srv := _testRegistry(t, testPackages{
+		"a@1.0.0": {"c": "^1.0.0"},
+		"b@1.0.0": {"c": "^2.0.0"},
+		"c@1.0.0": nil,
+		"c@2.0.0": nil,
+	})
+	defer srv.Close()
+
+	_, err := CalculateTree(r, &Package{Dependencies: _deps(t, map[string]string{"a": "^1", "b": "^1"})}, ResolveOptions{Solver: true})
+	if _, ok := err.(*SolverError); !ok {
+		t.Fatalf("Expected a solver error but got: %v\n", err)
+	}
+	expected := `Version solving failed because:
+  no version of a matching ^1 (from root) works:
+    a@1.0.0:
+      no version of b matching ^1 (from root) works:
+        b@1.0.0:
+          no version of c matches ^1.0.0 (from a@1.0.0) and ^2.0.0 (from b@1.0.0)`
+	if strings.TrimSpace(err.Error()) != expected {
+		t.Errorf("Expected error:\n%s\nbut got:\n%s", expected, err.Error())
+	}
+}
+
+func TestSolveTree_minReleaseAge(t *testing.T) {
+	r, srv := _testRegistry(t, testPackages{
+		"a@1.0.0": {"c": "^1.0.0"},
+		"c@1.0.0": {".published": _testAgo(30 * 24 * time.Hour)},
+		"c@1.1.0": {".published": _testAgo(30 * 24 * time.Hour)},
+		"c@1.2.0": {".published": _testAgo(time.Hour)},
+	})
+	defer srv.Close()
+	r.MinReleaseAge = 7 * 24 * time.Hour
+
+	tree, err := CalculateTree(r, &Package{Dependencies: _deps(t, map[string]string{"a": "^1"})}, ResolveOptions{Solver: true})
+	if err != nil {
+		t.Fatalf("Failed to solve: %s\n", err.Error())
+	}
+	_treeCheck(t, tree, map[string]string{"a": "1.0.0", "c": "1.1.0"})
+	if !r.warned["c@1.1.0"] {
+		t.Errorf("Expected a warning about c@1.2.0 being held back")
+	}
+
+	r.MinReleaseAge = 60 * 24 * time.Hour
+	_, err = CalculateTree(r, &Package{Dependencies: _deps(t, map[string]string{"a": "^1"})}, ResolveOptions{Solver: true})
+	if err == nil || !strings.Contains(err.Error(), "held back: 1.2.0, 1.1.0, 1.0.0") {
+		t.Errorf("Expected the versions of c to be held back but got: %v", err)
+	}
+}
+
+func TestSolveTree_overrides(t *testing.T) {
+	r, srv := _testRegistry(t, testPackages{
+		"a@1.0.0": {"c": "^1.0.0"},
+		"b@1.0.0": {"c": "^2.0.0"},
+		"c@1.0.0": nil,
+		"c@2.0.0": nil,
+	})
+	defer srv.Close()
+
+	root := &Package{
+		Dependencies: _deps(t, map[string]string{"a": "^1", "b": "^1"}),
+		Overrides:    []byte(`{"a": {"c": "^2.0.0"}}`),
+	}
+	tree, err := CalculateTree(r, root, ResolveOptions{Solver: true})
+	if err != nil {
+		t.Fatalf("Failed to solve: %s\n", err.Error())
+	}
+	_treeCheck(t, tree, map[string]string{
+		"a": "1.0.0",
+		"b": "1.0.0",
+		"c": "2.0.0",
+	})
+	if !tree.Nodes["c"].Overridden || tree.Nodes["a"].Overridden {
+		t.Errorf("Expected only c to be marked overridden")
+	}
+	if rng := tree.Nodes["a"].Requires["c"]; rng != "^2.0.0" {
+		t.Errorf("Expected a to be recorded as requiring the overridden range of c but got '%s'", rng)
+	}
+}
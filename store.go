@@ -0,0 +1,352 @@
+package main
+
+import (
+	"archive/tar"
+	"crypto/sha512"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// A Store keeps the contents of package files on disk once, keyed by their hash,
+// so they can be hardlinked into every project instead of extracted again
+type Store struct {
+	Dir string
+}
+
+// a storeIndex lists the files of a package in the store
+type storeIndex struct {
+	Files map[string]storeFile `json:"files"`
+}
+
+type storeFile struct {
+	Hash string      `json:"hash"`
+	Mode os.FileMode `json:"mode"`
+	Size int64       `json:"size"`
+	// MTime is when the file in the store was last written, in unix nanoseconds
+	MTime int64 `json:"mtime,omitempty"`
+}
+
+func NewStore(dir string) *Store {
+	return &Store{Dir: dir}
+}
+
+func (s *Store) filePath(hash string) string {
+	return filepath.Join(s.Dir, "files", hash[:2], hash[2:])
+}
+
+// indexPath is where the index of a package with the integrity is kept, e.g.
+// index/sha512/ab/cdef....json, so a tarball republished under the same name
+// and version, or coming from another registry, never shares an index
+func (s *Store) indexPath(i integrity) string {
+	h := i.Hex()
+	return filepath.Join(s.Dir, "index", i.algo, h[:2], h[2:]+".json")
+}
+
+// Install puts the files of a package into dest. Packages missing from the store are
+// added from their tarball first, which is only fetched when needed.
+func (s *Store) Install(n *DependencyNode, dest string, tarball func() (string, error)) error {
+	idx, err := s.index(n)
+	if err == nil {
+		err = s.verify(idx)
+		if err == nil {
+			return s.link(idx, dest)
+		}
+		if !os.IsNotExist(err) {
+			return err
+		}
+		log.Warnf("Store is missing files of %s@%s, adding it again", n.Name, n.Version)
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	src, err := tarball()
+	if err != nil {
+		return err
+	}
+	idx, err = s.add(n, src)
+	if err != nil {
+		return err
+	}
+	return s.link(idx, dest)
+}
+
+// index reads the list of files of a package in the store, failing with os.ErrNotExist
+// when it hasn't been added or its index is corrupt. Packages without an integrity
+// can't be looked up, so they're always added again from their tarball.
+func (s *Store) index(n *DependencyNode) (*storeIndex, error) {
+	i, ok := nodeIntegrity(n)
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+	data, err := ioutil.ReadFile(s.indexPath(i))
+	if err != nil {
+		return nil, err
+	}
+	idx := new(storeIndex)
+	err = json.Unmarshal(data, idx)
+	if err != nil {
+		log.Warnf("Ignoring corrupt store index for %s@%s: %s", n.Name, n.Version, err.Error())
+		return nil, os.ErrNotExist
+	}
+	return idx, nil
+}
+
+// add stores the files of a package tarball and writes its index
+func (s *Store) add(n *DependencyNode, tarball string) (*storeIndex, error) {
+	log.Debugln("Adding", n.Name+"@"+n.Version, "to the store")
+	idx := &storeIndex{Files: make(map[string]storeFile, 20)}
+	err := readTarball(tarball, func(name string, hdr *tar.Header, r io.Reader) error {
+		if hdr.Typeflag != tar.TypeReg {
+			return nil
+		}
+		f, err := s.addFile(r, fileMode(hdr.FileInfo().Mode()))
+		if err != nil {
+			return err
+		}
+		idx.Files[name] = f
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	i, ok := nodeIntegrity(n)
+	if !ok {
+		return idx, nil
+	}
+	data, err := json.Marshal(idx)
+	if err != nil {
+		return nil, err
+	}
+	err = writeFileAtomic(s.indexPath(i), data)
+	if err != nil {
+		return nil, err
+	}
+	return idx, nil
+}
+
+// verify checks that the files of a package are still in the store, with the size
+// and modification time they were added with, hashing the ones whose time moved.
+// Files that were changed, through a hardlink in some project, are removed, and it
+// fails with os.ErrNotExist so the package gets added again. Indexes written before
+// times were recorded only get their sizes checked.
+func (s *Store) verify(idx *storeIndex) error {
+	for _, name := range sortedStoreKeys(idx.Files) {
+		f := idx.Files[name]
+		path := s.filePath(f.Hash)
+		info, err := os.Stat(path)
+		if err != nil {
+			return err
+		}
+		changed := info.Size() != f.Size
+		if !changed && f.MTime != 0 && info.ModTime().UnixNano() != f.MTime {
+			hash, err := hashFile(path)
+			if err != nil {
+				return err
+			}
+			changed = hash != strings.TrimSuffix(f.Hash, "-exec")
+		}
+		if changed {
+			log.Warnf("Removing changed file %s from the store", f.Hash)
+			err = os.Remove(path)
+			if err != nil {
+				return err
+			}
+			return os.ErrNotExist
+		}
+	}
+	return nil
+}
+
+// addFile writes the contents of a file to the store unless it's already there
+func (s *Store) addFile(r io.Reader, mode os.FileMode) (storeFile, error) {
+	dir := filepath.Join(s.Dir, "files")
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return storeFile{}, err
+	}
+	tmp, err := ioutil.TempFile(dir, ".add-")
+	if err != nil {
+		return storeFile{}, err
+	}
+	defer os.Remove(tmp.Name())
+	h := sha512.New()
+	size, err := io.Copy(io.MultiWriter(tmp, h), r)
+	tmp.Close()
+	if err != nil {
+		return storeFile{}, err
+	}
+
+	//executable files are stored separately, since links share their mode
+	hash := hex.EncodeToString(h.Sum(nil))
+	if mode&0111 != 0 {
+		hash += "-exec"
+	}
+	f := storeFile{hash, mode, size, 0}
+	path := s.filePath(hash)
+	if info, err := os.Stat(path); err == nil && info.Size() == size {
+		f.MTime = info.ModTime().UnixNano()
+		return f, nil
+	}
+	err = os.Chmod(tmp.Name(), mode)
+	if err != nil {
+		return f, err
+	}
+	err = os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return f, err
+	}
+	err = os.Rename(tmp.Name(), path)
+	if err != nil {
+		return f, err
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return f, err
+	}
+	f.MTime = info.ModTime().UnixNano()
+	return f, nil
+}
+
+// hashFile returns the hex sha512 of a file's contents, as used for store paths
+func hashFile(path string) (string, error) {
+	fd, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer fd.Close()
+	h := sha512.New()
+	_, err = io.Copy(h, fd)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// link hardlinks the files of a package into dest, copying them when
+// that isn't possible, like when the store is on another device
+func (s *Store) link(idx *storeIndex, dest string) error {
+	err := os.MkdirAll(dest, 0755)
+	if err != nil {
+		return err
+	}
+	for _, name := range sortedStoreKeys(idx.Files) {
+		f := idx.Files[name]
+		target := filepath.Join(dest, filepath.FromSlash(name))
+		err = os.MkdirAll(filepath.Dir(target), 0755)
+		if err != nil {
+			return err
+		}
+		src := s.filePath(f.Hash)
+		err = os.Link(src, target)
+		if os.IsExist(err) {
+			os.Remove(target)
+			err = os.Link(src, target)
+		}
+		if err == nil {
+			continue
+		}
+		log.Debugf("Copying %s, unable to link it: %s", name, err.Error())
+		fd, err := os.Open(src)
+		if err != nil {
+			return err
+		}
+		err = extractFile(fd, target, f.Mode)
+		fd.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// detachPackage replaces the files of a package installed from the store with copies,
+// so changing them in place, like install scripts may, leaves the store alone.
+// Packages in its own node_modules are left as they are.
+func detachPackage(dir string) error {
+	return filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() && info.Name() == "node_modules" && path != dir {
+			return filepath.SkipDir
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		return copyFile(path, info.Mode().Perm())
+	})
+}
+
+// copyFile replaces a file with a copy of itself, breaking any hardlink it's part of
+func copyFile(file string, mode os.FileMode) error {
+	src, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	tmp, err := ioutil.TempFile(filepath.Dir(file), ".copy-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = io.Copy(tmp, src)
+	tmp.Close()
+	if err != nil {
+		return err
+	}
+	err = os.Chmod(tmp.Name(), mode)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), file)
+}
+
+// Clean removes everything from the store
+func (s *Store) Clean() error {
+	return os.RemoveAll(s.Dir)
+}
+
+func sortedStoreKeys(m map[string]storeFile) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// writeFileAtomic writes a file through a temporary one, so readers never see it half written
+func writeFileAtomic(path string, data []byte) error {
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(path), ".write-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(data)
+	if err != nil {
+		tmp.Close()
+		return err
+	}
+	err = tmp.Close()
+	if err != nil {
+		return err
+	}
+	err = os.Chmod(tmp.Name(), 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
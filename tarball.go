@@ -0,0 +1,169 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"errors"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// limits on what a tarball may unpack to, so a small download can't fill the disk
+var (
+	maxTarballSize    int64 = 1 << 30
+	maxTarballEntries       = 100000
+)
+
+// readTarball calls fn for every file and directory of a package tarball, with the name
+// relative to the leading "package/" directory every npm tarball is wrapped in.
+//
+// Tarballs come from anyone, so entries that would end up outside the package fail the
+// whole tarball, as do devices and tarballs unpacking to more than maxTarballSize.
+// Links within the package are skipped, like npm does.
+func readTarball(src string, fn func(name string, hdr *tar.Header, r io.Reader) error) error {
+	fd, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+	gz, err := gzip.NewReader(fd)
+	if err != nil {
+		return err
+	}
+	defer gz.Close()
+
+	//counts headers and padding too, which is what a bomb of empty entries is made of
+	lr := &io.LimitedReader{R: gz, N: maxTarballSize + 1}
+	tr := tar.NewReader(lr)
+	for entries := 0; ; entries++ {
+		hdr, err := tr.Next()
+		if lr.N <= 0 || entries > maxTarballEntries {
+			return errors.New("Tarball unpacks to more than the limit: " + src)
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		full, err := tarEntryPath(hdr.Name)
+		if err != nil {
+			return err
+		}
+		i := strings.IndexRune(full, '/')
+		if i == -1 {
+			continue
+		}
+		name := full[i+1:]
+
+		switch hdr.Typeflag {
+		case tar.TypeReg, tar.TypeDir:
+		case tar.TypeSymlink, tar.TypeLink:
+			err = checkTarLink(full, hdr)
+			if err != nil {
+				return err
+			}
+			log.Debugf("Skipping link in tarball %s: %s -> %s", src, name, hdr.Linkname)
+			continue
+		case tar.TypeChar, tar.TypeBlock, tar.TypeFifo:
+			return errors.New("Device file in tarball: " + hdr.Name)
+		default:
+			continue
+		}
+		if hdr.Size > maxTarballSize {
+			return errors.New("Tarball unpacks to more than the limit: " + src)
+		}
+		err = fn(name, hdr, tr)
+		if lr.N <= 0 {
+			return errors.New("Tarball unpacks to more than the limit: " + src)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// tarEntryPath cleans the name of a tarball entry, failing if it's absolute or
+// leads out of the tarball. Backslashes count as separators, like on windows.
+func tarEntryPath(name string) (string, error) {
+	name = strings.Replace(name, "\\", "/", -1)
+	if strings.HasPrefix(name, "/") || (len(name) > 1 && name[1] == ':') {
+		return "", errors.New("Absolute path in tarball: " + name)
+	}
+	if strings.ContainsRune(name, 0) {
+		return "", errors.New("Invalid path in tarball: " + name)
+	}
+	clean := path.Clean(name)
+	if clean == ".." || strings.HasPrefix(clean, "../") {
+		return "", errors.New("Path outside the package in tarball: " + name)
+	}
+	return clean, nil
+}
+
+// checkTarLink fails for links pointing outside the package. Symlinks are
+// relative to where they are, hardlinks to the root of the tarball.
+func checkTarLink(full string, hdr *tar.Header) error {
+	target := hdr.Linkname
+	if hdr.Typeflag == tar.TypeSymlink {
+		if strings.HasPrefix(target, "/") || strings.HasPrefix(target, "\\") {
+			return errors.New("Link outside the package in tarball: " + hdr.Name + " -> " + hdr.Linkname)
+		}
+		target = path.Join(path.Dir(full), target)
+	}
+	clean, err := tarEntryPath(target)
+	pkgDir := full[:strings.IndexRune(full+"/", '/')]
+	if err != nil || !strings.HasPrefix(clean+"/", pkgDir+"/") || clean == pkgDir {
+		return errors.New("Link outside the package in tarball: " + hdr.Name + " -> " + hdr.Linkname)
+	}
+	return nil
+}
+
+// extractTarball unpacks a package tarball into dest
+func extractTarball(src, dest string) error {
+	err := os.MkdirAll(dest, 0755)
+	if err != nil {
+		return err
+	}
+	return readTarball(src, func(name string, hdr *tar.Header, r io.Reader) error {
+		target := filepath.Join(dest, filepath.FromSlash(name))
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			return os.MkdirAll(target, 0755)
+		case tar.TypeReg:
+			return extractFile(r, target, hdr.FileInfo().Mode())
+		}
+		return nil
+	})
+}
+
+// fileMode normalizes a file mode to 0755 or 0644, depending on if anyone could execute it,
+// the way npm does. Setuid, setgid and sticky bits never make it through.
+func fileMode(mode os.FileMode) os.FileMode {
+	if mode&0111 != 0 {
+		return 0755
+	}
+	return 0644
+}
+
+func extractFile(r io.Reader, target string, mode os.FileMode) error {
+	err := os.MkdirAll(filepath.Dir(target), 0755)
+	if err != nil {
+		return err
+	}
+	fd, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, fileMode(mode))
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(fd, r)
+	if err != nil {
+		fd.Close()
+		return err
+	}
+	return fd.Close()
+}
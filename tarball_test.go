@@ -0,0 +1,100 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// _testRawTarball writes a tarball with the given entries as they are, to a file in dir
+func _testRawTarball(t *testing.T, dir string, entries []*tar.Header) string {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	for _, hdr := range entries {
+		err := tw.WriteHeader(hdr)
+		if err != nil {
+			t.Fatalf("Failed to write tar header: %s\n", err.Error())
+		}
+		tw.Write(bytes.Repeat([]byte("x"), int(hdr.Size)))
+	}
+	tw.Close()
+	gz.Close()
+	path := filepath.Join(dir, "test.tgz")
+	err := ioutil.WriteFile(path, buf.Bytes(), 0644)
+	if err != nil {
+		t.Fatalf("Failed to write tarball: %s\n", err.Error())
+	}
+	return path
+}
+
+func TestExtractTarball_unsafe(t *testing.T) {
+	dir := _testDir(t, "fpm-tarball")
+	file := func(name string) *tar.Header {
+		return &tar.Header{Name: name, Mode: 0644, Size: 1, Typeflag: tar.TypeReg}
+	}
+	link := func(typ byte, name, target string) *tar.Header {
+		return &tar.Header{Name: name, Linkname: target, Mode: 0777, Typeflag: typ}
+	}
+
+	cases := map[string][]*tar.Header{
+		"traversal":       {file("package/../../evil")},
+		"absolute":        {file("/tmp/evil")},
+		"backslashes":     {file("package\\..\\..\\evil")},
+		"symlink escape":  {link(tar.TypeSymlink, "package/lib", "../../..")},
+		"absolute link":   {link(tar.TypeSymlink, "package/lib", "/etc")},
+		"hardlink escape": {link(tar.TypeLink, "package/passwd", "../etc/passwd")},
+		"device":          {{Name: "package/dev", Mode: 0644, Typeflag: tar.TypeChar, Devmajor: 1, Devminor: 3}},
+		"too big":         {file("package/a"), {Name: "package/b", Mode: 0644, Size: 8192, Typeflag: tar.TypeReg}},
+	}
+	limit := maxTarballSize
+	maxTarballSize = 4096
+	//the package is nested deep enough that every escape above still lands in root
+	root := filepath.Join(dir, "root")
+	dest := filepath.Join(root, "project", "node_modules", "pkg")
+	for name, entries := range cases {
+		err := extractTarball(_testRawTarball(t, dir, entries), dest)
+		if err == nil {
+			t.Errorf("Expected %s to be rejected", name)
+		}
+		filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+			if err == nil && !info.IsDir() && !strings.HasPrefix(path, dest+string(filepath.Separator)) {
+				t.Errorf("Expected nothing to be written outside the package for %s, but found %s", name, path)
+			}
+			return nil
+		})
+		os.RemoveAll(root)
+	}
+	maxTarballSize = limit
+
+	//links inside the package are left out, and modes are normalized
+	entries := []*tar.Header{
+		{Name: "package/bin/run", Mode: 04777, Size: 1, Typeflag: tar.TypeReg},
+		{Name: "package/index.js", Mode: 0600, Size: 1, Typeflag: tar.TypeReg},
+		link(tar.TypeSymlink, "package/lib", "bin"),
+	}
+	dest = filepath.Join(dir, "ok")
+	err := extractTarball(_testRawTarball(t, dir, entries), dest)
+	if err != nil {
+		t.Fatalf("Failed to extract: %s\n", err.Error())
+	}
+	for name, mode := range map[string]os.FileMode{"bin/run": 0755, "index.js": 0644} {
+		info, err := os.Stat(filepath.Join(dest, filepath.FromSlash(name)))
+		if err != nil {
+			t.Errorf("Failed to stat %s: %s", name, err.Error())
+			continue
+		}
+		//the umask may take away more, but never add
+		if info.Mode()&^mode != 0 {
+			t.Errorf("Expected %s to have mode %s but got %s", name, mode, info.Mode())
+		}
+	}
+	if _, err := os.Lstat(filepath.Join(dest, "lib")); err == nil {
+		t.Errorf("Expected links to be skipped")
+	}
+}